@@ -0,0 +1,167 @@
+/**
+ * Copyright (c) 2016-present, Facebook, Inc.
+ * All rights reserved.
+ *
+ * This source code is licensed under the BSD-style license found in the
+ * LICENSE file in the root directory of this source tree. An additional grant
+ * of patent rights can be found in the PATENTS file in the same directory.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// the weight of the near end of the failing link in the blame score, the far end weighs 1
+const lastGoodBlame = 0.5
+
+// HopBlame tells how much a responding hop is to blame for the loss seen across all the paths
+type HopBlame struct {
+	Name string
+	// the ttls the hop was seen at
+	TTLs []int
+	// number of lossy and healthy source ports crossing the hop
+	Lossy   int
+	Healthy int
+	// where the loss of the lossy source ports starts relative to the hop: further down the path,
+	// right after it, at it, or already before it
+	Upstream   int
+	LastGood   int
+	FirstBad   int
+	Downstream int
+	// the share of the lossy ports whose break is next to the hop, times the share of lossy ports among
+	// all the ports crossing it: 1 means every lossy port breaks at the hop and every port crossing it is lossy
+	Score float64
+}
+
+//
+// Rank the responding hops by how likely they are to cause the loss. A hop is suspect when the lossy
+// source ports break right at it, and more so when the healthy ports stay away from it: a router
+// carrying as many healthy ports as lossy ones is unlikely to be dropping the packets, no matter where
+// the loss shows up. The break position comes from the detector verdicts, the paths from the hop vectors
+//
+func rankBlame(hops map[int] /* src port */ []string, verdicts map[int] /* src port */ Verdict) []*HopBlame {
+	blames := make(map[string]*HopBlame)
+	totalLossy := 0
+
+	for srcPort, path := range hops {
+		verdict := verdicts[srcPort]
+		lossy := verdict.Lossy && verdict.Break != nil
+		if lossy {
+			totalLossy++
+		}
+
+		seen := make(map[string]bool)
+		for i, name := range path {
+			// a ttl that never answered is no device to drain
+			if name == "" || name == "?" || name == nonResponding {
+				continue
+			}
+			blame := blames[name]
+			if blame == nil {
+				blame = &HopBlame{Name: name}
+				blames[name] = blame
+			}
+			ttl := i + 1
+			blame.TTLs = appendTTL(blame.TTLs, ttl)
+
+			// count every port once per hop, even if it crosses the hop twice
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			if !lossy {
+				blame.Healthy++
+				continue
+			}
+			blame.Lossy++
+			switch {
+			case ttl < verdict.Break.LastGoodTTL:
+				blame.Upstream++
+			case ttl == verdict.Break.LastGoodTTL:
+				blame.LastGood++
+			case ttl <= verdict.Break.FirstBadTTL:
+				// the hops in between were left out of the detection, they are just as suspect
+				blame.FirstBad++
+			default:
+				blame.Downstream++
+			}
+		}
+	}
+
+	var result []*HopBlame
+	for _, blame := range blames {
+		if blame.Lossy == 0 {
+			continue
+		}
+		coverage := (float64(blame.FirstBad) + lastGoodBlame*float64(blame.LastGood)) / float64(totalLossy)
+		specificity := float64(blame.Lossy) / float64(blame.Lossy+blame.Healthy)
+		blame.Score = coverage * specificity
+		result = append(result, blame)
+	}
+	sort.Sort(hopsByBlame(result))
+
+	return result
+}
+
+// Add the ttl to the sorted list of ttls, unless it is there already
+func appendTTL(ttls []int, ttl int) []int {
+	for _, t := range ttls {
+		if t == ttl {
+			return ttls
+		}
+	}
+	ttls = append(ttls, ttl)
+	sort.Ints(ttls)
+	return ttls
+}
+
+type hopsByBlame []*HopBlame
+
+func (h hopsByBlame) Len() int      { return len(h) }
+func (h hopsByBlame) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h hopsByBlame) Less(i, j int) bool {
+	if h[i].Score != h[j].Score {
+		return h[i].Score > h[j].Score
+	}
+	// the hop fewer healthy ports go through is the more likely one
+	si := float64(h[i].Lossy) / float64(h[i].Lossy+h[i].Healthy)
+	sj := float64(h[j].Lossy) / float64(h[j].Lossy+h[j].Healthy)
+	if si != sj {
+		return si > sj
+	}
+	if h[i].TTLs[0] != h[j].TTLs[0] {
+		return h[i].TTLs[0] < h[j].TTLs[0]
+	}
+	return h[i].Name < h[j].Name
+}
+
+//
+// print the hops crossed by the lossy paths, the ones to drain first at the top
+//
+func printBlame(blames []*HopBlame) {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"rank", "hop", "TTL", "lossy/healthy ports", "upstream", "last good", "first bad", "downstream", "score"})
+	for rank, blame := range blames {
+		var ttls string
+		for i, ttl := range blame.TTLs {
+			if i > 0 {
+				ttls += ","
+			}
+			ttls += fmt.Sprintf("%d", ttl)
+		}
+		table.Append([]string{fmt.Sprintf("%d", rank+1), blame.Name, ttls, fmt.Sprintf("%d/%d", blame.Lossy, blame.Healthy),
+			fmt.Sprintf("%d", blame.Upstream), fmt.Sprintf("%d", blame.LastGood), fmt.Sprintf("%d", blame.FirstBad),
+			fmt.Sprintf("%d", blame.Downstream), fmt.Sprintf("%.2f", blame.Score)})
+	}
+
+	fmt.Fprintf(os.Stdout, "Blame ranking:\n")
+	table.Render()
+	fmt.Fprintf(os.Stdout, "\n")
+}
@@ -0,0 +1,141 @@
+/**
+ * Copyright (c) 2016-present, Facebook, Inc.
+ * All rights reserved.
+ *
+ * This source code is licensed under the BSD-style license found in the
+ * LICENSE file in the root directory of this source tree. An additional grant
+ * of patent rights can be found in the PATENTS file in the same directory.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+)
+
+// every calibration burst lasts that many seconds, the slow one runs that many times below the probe rate
+const (
+	calibrationTime     = 3
+	calibrationSlowdown = 8
+)
+
+// Calibration is the response ceiling of the target, measured before tracing
+type Calibration struct {
+	// the probes sent to the target and answered by it in the slow burst, and the rate of that burst
+	SlowSent int
+	SlowRcvd int
+	SlowRate int
+	// the same at the probe rate
+	Sent int
+	Rcvd int
+	Rate int
+	// the target answers significantly fewer probes at the probe rate than in the slow burst
+	Limited bool
+	// the fraction of the probes the target answers at the probe rate relative to the slow burst, 1 unless Limited
+	HitRate float64
+}
+
+//
+// Measure how many of our probes the target answers because of its own rate limit: many hosts rate-limit their
+// RSTs (e.g. tcp_invalid_ratelimit on Linux) and ICMP errors, so every path would look lossy at the target.
+// The loss on the way to the target does not depend on our probe rate, while a rate limit does: we send a slow
+// burst and then a burst at the probe rate over the same source ports, with the ttl high enough to reach the
+// target, and count the responses coming in on the given channel. The ceiling is the ratio of the two hit rates,
+// provided the one-sided two-proportion z-test finds it below 1 at the given significance level
+//
+func calibrate(table *ProbeTable, in <-chan interface{}, start func(pps int) senderFunc, ttl int, srcPorts []int, pps int, alpha float64) (*Calibration, error) {
+	calibration := Calibration{Rate: pps, SlowRate: pps / calibrationSlowdown, HitRate: 1}
+	if calibration.SlowRate < 1 {
+		calibration.SlowRate = 1
+	}
+
+	// the slow burst takes a single round over the ports, the fast one loops over the same ports
+	ports := srcPorts
+	if len(ports) > calibrationTime*calibration.SlowRate {
+		ports = ports[:calibrationTime*calibration.SlowRate]
+	}
+	if len(ports) == 0 {
+		return &calibration, nil
+	}
+
+	var err error
+	calibration.SlowSent, calibration.SlowRcvd, err = calibrationBurst(table, in, start(calibration.SlowRate), ttl, ports, 1)
+	if err != nil {
+		return nil, err
+	}
+	iters := (calibrationTime*pps + len(ports) - 1) / len(ports)
+	calibration.Sent, calibration.Rcvd, err = calibrationBurst(table, in, start(pps), ttl, ports, iters)
+	if err != nil {
+		return nil, err
+	}
+
+	if calibration.SlowSent == 0 || calibration.Sent == 0 || calibration.SlowRcvd == 0 {
+		return &calibration, nil
+	}
+
+	slowHitRate := float64(calibration.SlowRcvd) / float64(calibration.SlowSent)
+	hitRate := float64(calibration.Rcvd) / float64(calibration.Sent)
+	pooled := float64(calibration.SlowRcvd+calibration.Rcvd) / float64(calibration.SlowSent+calibration.Sent)
+	stdErr := math.Sqrt(pooled * (1 - pooled) * (1/float64(calibration.SlowSent) + 1/float64(calibration.Sent)))
+	if stdErr > 0 && (slowHitRate-hitRate)/stdErr >= normalQuantile(1-alpha) {
+		calibration.Limited = true
+		calibration.HitRate = hitRate / slowHitRate
+	}
+
+	return &calibration, nil
+}
+
+// Send a calibration burst, returning the number of probes sent and answered by the target
+func calibrationBurst(table *ProbeTable, in <-chan interface{}, start senderFunc, ttl int, srcPorts []int, iters int) (int, int, error) {
+	responses, sent, err := probeRound(table, in, start, ttl, srcPorts, iters)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rcvd := 0
+	for _, list := range responses {
+		for _, resp := range list {
+			if resp.target {
+				rcvd++
+			}
+		}
+	}
+
+	return sent, rcvd, nil
+}
+
+//
+// Scale the hit rate of the target, the last hop of the path, by its response ceiling if calibration found one.
+// Returns a copy of the rcvd vector, the other hops are left as they are
+//
+func calibrateRcvd(sent, rcvd []int, calibration *Calibration) []int {
+	result := make([]int, len(rcvd))
+	copy(result, rcvd)
+
+	if calibration == nil || !calibration.Limited || calibration.HitRate <= 0 || calibration.HitRate >= 1 || len(rcvd) == 0 {
+		return result
+	}
+
+	last := len(rcvd) - 1
+	scaled := int(math.Floor(float64(rcvd[last])/calibration.HitRate + 0.5))
+	if scaled > sent[last] {
+		scaled = sent[last]
+	}
+	result[last] = scaled
+
+	return result
+}
+
+//
+// print the outcome of the calibration
+//
+func printCalibration(calibration *Calibration) {
+	fmt.Fprintf(os.Stdout, "Target answered %d of %d calibration probes at %d pps and %d of %d at %d pps", calibration.SlowRcvd, calibration.SlowSent, calibration.SlowRate, calibration.Rcvd, calibration.Sent, calibration.Rate)
+	if calibration.Limited {
+		fmt.Fprintf(os.Stdout, ": rate-limited, its hit rates are scaled by 1/%.2f\n\n", calibration.HitRate)
+	} else {
+		fmt.Fprintf(os.Stdout, ": no rate limit found\n\n")
+	}
+}
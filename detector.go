@@ -0,0 +1,196 @@
+/**
+ * Copyright (c) 2016-present, Facebook, Inc.
+ * All rights reserved.
+ *
+ * This source code is licensed under the BSD-style license found in the
+ * LICENSE file in the root directory of this source tree. An additional grant
+ * of patent rights can be found in the PATENTS file in the same directory.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// PathData is everything main has assembled about the path of one source port
+type PathData struct {
+	SrcPort int
+	// the ttl of every entry in the vectors below; the hops excluded from the loss computation leave gaps
+	TTLs []int
+	Sent []int
+	Rcvd []int
+	Hops []string
+	RTT  []RTTStats
+}
+
+// Assemble the path data from the vectors indexed by ttl-1
+func newPathData(srcPort int, sent, rcvd []int, hops []string, rtt []RTTStats) *PathData {
+	ttls := make([]int, len(sent))
+	for i := range ttls {
+		ttls[i] = i + 1
+	}
+	return &PathData{SrcPort: srcPort, TTLs: ttls, Sent: sent, Rcvd: rcvd, Hops: hops, RTT: rtt}
+}
+
+// Leave out the hops flagged in the exclude vector, indexed by ttl-1, so that detectors never see them
+func excludeHops(path *PathData, exclude []bool) *PathData {
+	result := &PathData{SrcPort: path.SrcPort}
+	for i, ttl := range path.TTLs {
+		if ttl-1 < len(exclude) && exclude[ttl-1] {
+			continue
+		}
+		result.TTLs = append(result.TTLs, ttl)
+		result.Sent = append(result.Sent, path.Sent[i])
+		result.Rcvd = append(result.Rcvd, path.Rcvd[i])
+		result.Hops = append(result.Hops, path.Hops[i])
+		result.RTT = append(result.RTT, path.RTT[i])
+	}
+	return result
+}
+
+// Verdict is the opinion of a detector about one path
+type Verdict struct {
+	Lossy bool
+	// where the loss starts, if the path is lossy
+	Break *LossBreak
+	// human readable reasoning behind the verdict
+	Explanation string
+}
+
+// Detector finds lossy paths. It gets all the paths at once, so that it can
+// compare them against each other, and returns a verdict per source port
+type Detector interface {
+	Detect(paths map[int] /* src port */ *PathData) map[int] /* src port */ Verdict
+}
+
+// the available detectors, by the name used with -detector
+var detectors = make(map[string]func() Detector)
+
+// Make a detector available by name, meant to be called from init() so that
+// new detectors can live in their own files
+func registerDetector(name string, factory func() Detector) {
+	detectors[name] = factory
+}
+
+// Create a detector by name
+func newDetector(name string) (Detector, error) {
+	factory, ok := detectors[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown loss detector %s, known detectors are %v", name, detectorNames())
+	}
+	return factory(), nil
+}
+
+// Names of the registered detectors, sorted
+func detectorNames() []string {
+	var names []string
+	for name := range detectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	registerDetector("monotonic", func() Detector { return monotonicDetector{} })
+	registerDetector("binomial", func() Detector { return binomialDetector{alpha: *significance} })
+}
+
+// Describe the loss break found at the given index of the path
+func newLossBreak(path *PathData, lastGood int, step float64) *LossBreak {
+	return &LossBreak{
+		LastGoodTTL: path.TTLs[lastGood],
+		LastGoodHop: path.Hops[lastGood],
+		FirstBadTTL: path.TTLs[lastGood+1],
+		FirstBadHop: path.Hops[lastGood+1],
+		Step:        step,
+	}
+}
+
+// monotonicDetector is the strict rule of isLossy: every hop after the break has a lower hit rate
+type monotonicDetector struct{}
+
+func (monotonicDetector) Detect(paths map[int] /* src port */ *PathData) map[int] /* src port */ Verdict {
+	verdicts := make(map[int]Verdict)
+
+	for srcPort, path := range paths {
+		norm, err := normalizeRcvd(path.Sent, path.Rcvd)
+		if err != nil {
+			verdicts[srcPort] = Verdict{Explanation: fmt.Sprintf("Could not normalize %v / %v", path.Rcvd, path.Sent)}
+			continue
+		}
+
+		lastGood, step, lossy := isLossy(norm)
+		if !lossy {
+			verdicts[srcPort] = Verdict{Explanation: "no hop is followed by lower hit rates only"}
+			continue
+		}
+
+		verdicts[srcPort] = Verdict{
+			Lossy: true,
+			Break: newLossBreak(path, lastGood, step),
+			Explanation: fmt.Sprintf("every hop after ttl %d has lower hit rate than its %.0f%%, the best of them is %.0f%%",
+				path.TTLs[lastGood], 100*norm[lastGood], 100*(norm[lastGood]-step)),
+		}
+	}
+
+	return verdicts
+}
+
+// binomialDetector runs the change-point test of isLossyBinomial at the given significance level
+type binomialDetector struct {
+	alpha float64
+}
+
+func (d binomialDetector) Detect(paths map[int] /* src port */ *PathData) map[int] /* src port */ Verdict {
+	verdicts := make(map[int]Verdict)
+
+	for srcPort, path := range paths {
+		if len(path.Sent) != len(path.Rcvd) {
+			verdicts[srcPort] = Verdict{Explanation: fmt.Sprintf("Length mismatch for sent/rcvd %v / %v", path.Sent, path.Rcvd)}
+			continue
+		}
+
+		lastGood, step, z, lossy := isLossyBinomial(path.Sent, path.Rcvd, d.alpha)
+		if !lossy {
+			verdicts[srcPort] = Verdict{Explanation: fmt.Sprintf("no significant drop of the hit rate at %.2f level, best z score %.2f", d.alpha, z)}
+			continue
+		}
+
+		verdicts[srcPort] = Verdict{
+			Lossy:       true,
+			Break:       newLossBreak(path, lastGood, step),
+			Explanation: fmt.Sprintf("hit rate drops by %.0f%% after ttl %d, z score %.2f is significant at %.2f level", 100*step, path.TTLs[lastGood], z, d.alpha),
+		}
+	}
+
+	return verdicts
+}
+
+//
+// print the explanations of the detector verdicts for the lossy paths
+//
+func printVerdicts(verdicts map[int] /* src port */ Verdict) {
+	var allPorts []int
+	for srcPort, v := range verdicts {
+		if v.Lossy {
+			allPorts = append(allPorts, srcPort)
+		}
+	}
+	sort.Ints(allPorts)
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"port", "verdict"})
+	for _, srcPort := range allPorts {
+		table.Append([]string{fmt.Sprintf("%d", srcPort), verdicts[srcPort].Explanation})
+	}
+
+	fmt.Fprintf(os.Stdout, "Loss verdicts:\n")
+	table.Render()
+	fmt.Fprintf(os.Stdout, "\n")
+}
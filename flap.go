@@ -0,0 +1,268 @@
+/**
+ * Copyright (c) 2016-present, Facebook, Inc.
+ * All rights reserved.
+ *
+ * This source code is licensed under the BSD-style license found in the
+ * LICENSE file in the root directory of this source tree. An additional grant
+ * of patent rights can be found in the PATENTS file in the same directory.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// the behaviours behind the hop changes of a source port at some ttl
+const (
+	// every packet of the flow may go to any of the next hops
+	flapPerPacket = "per-packet load balancing"
+	// the flow moved over to other hops once and stayed there, or moved along with the other flows every time
+	flapRouteChange = "route change"
+	// the flow moves back and forth between the same hops on its own, much less often than per-packet balancing would
+	flapUnstableHash = "unstable hashing"
+)
+
+// hop changes on different source ports at the same ttl less than that many nanoseconds apart happen together
+const flapWindow = int64(time.Second)
+
+// FlapEvent is a change of the hop answering a source port at some ttl
+type FlapEvent struct {
+	// nanoseconds since tracing started
+	Time int64
+	From string
+	To   string
+}
+
+// FlapHistory is every hop change of a source port at a ttl, in the order the responses were received
+type FlapHistory struct {
+	SrcPort int
+	TTL     int
+	Events  []FlapEvent
+	// the responses per hop name, over the whole run
+	Seen map[string]int
+	// the behaviour behind the changes
+	Behaviour string
+}
+
+// a hop answering a source port at some ttl, and when
+type flapResponse struct {
+	received int64
+	name     string
+}
+
+//
+// flapRecorder keeps the responses per source port and ttl. They come from the resolver goroutines in no
+// particular order, so the hop changes are only worked out once they are sorted by the time they were received
+//
+type flapRecorder struct {
+	start     int64
+	current   map[int] /* src port */ map[int] /* ttl */ string
+	responses map[int] /* src port */ map[int] /* ttl */ []flapResponse
+	events    map[int] /* src port */ map[int] /* ttl */ []FlapEvent
+}
+
+func newFlapRecorder(start int64) *flapRecorder {
+	return &flapRecorder{
+		start:     start,
+		current:   make(map[int]map[int]string),
+		responses: make(map[int]map[int][]flapResponse),
+		events:    make(map[int]map[int][]FlapEvent),
+	}
+}
+
+// Record the hop answering the source port at the ttl, at the given monotonic time.
+// Returns true if that is a different hop than the one that answered before it in arrival order
+func (f *flapRecorder) observe(srcPort, ttl int, name string, received int64) bool {
+	if f.current[srcPort] == nil {
+		f.current[srcPort] = make(map[int]string)
+		f.responses[srcPort] = make(map[int][]flapResponse)
+	}
+	f.responses[srcPort][ttl] = append(f.responses[srcPort][ttl], flapResponse{received: received, name: name})
+
+	prev, ok := f.current[srcPort][ttl]
+	f.current[srcPort][ttl] = name
+	return ok && prev != name
+}
+
+// Work out the hop changes of every source port and ttl from its responses sorted by the time they were received
+func (f *flapRecorder) replay() {
+	f.events = make(map[int]map[int][]FlapEvent)
+	for srcPort, perTTL := range f.responses {
+		for ttl, responses := range perTTL {
+			sort.Stable(responsesByTime(responses))
+			var events []FlapEvent
+			for i := 1; i < len(responses); i++ {
+				if prev := responses[i-1].name; prev != responses[i].name {
+					events = append(events, FlapEvent{Time: responses[i].received - f.start, From: prev, To: responses[i].name})
+				}
+			}
+			if len(events) == 0 {
+				continue
+			}
+			if f.events[srcPort] == nil {
+				f.events[srcPort] = make(map[int][]FlapEvent)
+			}
+			f.events[srcPort][ttl] = events
+		}
+	}
+}
+
+// Build the flap histories of all the source ports and ttls that saw their hop change, the hops shown with the given labels
+func (f *flapRecorder) histories(label func(hop string) string) []*FlapHistory {
+	f.replay()
+
+	var result []*FlapHistory
+	for srcPort, perTTL := range f.events {
+		for ttl, events := range perTTL {
+			h := &FlapHistory{SrcPort: srcPort, TTL: ttl, Seen: make(map[string]int)}
+			for _, e := range events {
+				h.Events = append(h.Events, FlapEvent{Time: e.Time, From: label(e.From), To: label(e.To)})
+			}
+			for _, resp := range f.responses[srcPort][ttl] {
+				h.Seen[label(resp.name)]++
+			}
+			h.Behaviour = classifyFlaps(h)
+			result = append(result, h)
+		}
+	}
+	sort.Sort(flapsByPort(result))
+
+	// rehashing moves a single flow, while a route flapping back and forth moves all the flows crossing it at once
+	for _, h := range result {
+		if h.Behaviour != flapUnstableHash {
+			continue
+		}
+		together := 0
+		for _, e := range h.Events {
+			if f.changedTogether(h.SrcPort, h.TTL, e.Time) {
+				together++
+			}
+		}
+		if 2*together >= len(h.Events) {
+			h.Behaviour = flapRouteChange
+		}
+	}
+
+	return result
+}
+
+// Tell if some other source port changed its hop at the ttl around the given time
+func (f *flapRecorder) changedTogether(srcPort, ttl int, t int64) bool {
+	for port, perTTL := range f.events {
+		if port == srcPort {
+			continue
+		}
+		for _, e := range perTTL[ttl] {
+			if e.Time > t-flapWindow && e.Time < t+flapWindow {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//
+// Tell what makes a flow change its hop. If the flow never goes back to a hop it left, the route changed
+// while tracing. Otherwise we compare how often it switched to how often it would if every packet picked
+// the next hop independently, with the probabilities seen: per-packet balancing switches on close to
+// 1 - sum(p^2) of the responses, while a flow rehashed now and then stays on a hop for long stretches
+//
+func classifyFlaps(h *FlapHistory) string {
+	visited := map[string]bool{h.Events[0].From: true}
+	revisits := false
+	for _, e := range h.Events {
+		if visited[e.To] {
+			revisits = true
+		}
+		visited[e.To] = true
+	}
+	if !revisits {
+		return flapRouteChange
+	}
+
+	total := 0
+	for _, count := range h.Seen {
+		total += count
+	}
+	if total < 2 {
+		return flapUnstableHash
+	}
+	var sumSquares float64
+	for _, count := range h.Seen {
+		p := float64(count) / float64(total)
+		sumSquares += p * p
+	}
+	switchRate := float64(len(h.Events)) / float64(total-1)
+	if switchRate >= (1-sumSquares)/2 {
+		return flapPerPacket
+	}
+	return flapUnstableHash
+}
+
+// The names of the hops seen, most answering first
+func flapHopNames(h *FlapHistory) []string {
+	var names []string
+	for name := range h.Seen {
+		names = append(names, name)
+	}
+	sort.Sort(namesBySeen{names: names, seen: h.Seen})
+	return names
+}
+
+type namesBySeen struct {
+	names []string
+	seen  map[string]int
+}
+
+func (n namesBySeen) Len() int      { return len(n.names) }
+func (n namesBySeen) Swap(i, j int) { n.names[i], n.names[j] = n.names[j], n.names[i] }
+func (n namesBySeen) Less(i, j int) bool {
+	if n.seen[n.names[i]] != n.seen[n.names[j]] {
+		return n.seen[n.names[i]] > n.seen[n.names[j]]
+	}
+	return n.names[i] < n.names[j]
+}
+
+type responsesByTime []flapResponse
+
+func (r responsesByTime) Len() int           { return len(r) }
+func (r responsesByTime) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r responsesByTime) Less(i, j int) bool { return r[i].received < r[j].received }
+
+type flapsByPort []*FlapHistory
+
+func (f flapsByPort) Len() int      { return len(f) }
+func (f flapsByPort) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+func (f flapsByPort) Less(i, j int) bool {
+	if f[i].SrcPort != f[j].SrcPort {
+		return f[i].SrcPort < f[j].SrcPort
+	}
+	return f[i].TTL < f[j].TTL
+}
+
+//
+// print the hop changes per source port and ttl, with the times of the first and last change
+//
+func printFlaps(flaps []*FlapHistory) {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"src port", "TTL", "hops seen", "changes", "first change s", "last change s", "behaviour"})
+	for _, h := range flaps {
+		var seen []string
+		for _, name := range flapHopNames(h) {
+			seen = append(seen, fmt.Sprintf("%s (%d)", name, h.Seen[name]))
+		}
+		table.Append([]string{fmt.Sprintf("%d", h.SrcPort), fmt.Sprintf("%d", h.TTL), strings.Join(seen, ", "), fmt.Sprintf("%d", len(h.Events)),
+			fmt.Sprintf("%.2f", float64(h.Events[0].Time)/1e9), fmt.Sprintf("%.2f", float64(h.Events[len(h.Events)-1].Time)/1e9), h.Behaviour})
+	}
+
+	fmt.Fprintf(os.Stdout, "Path flaps:\n")
+	table.Render()
+	fmt.Fprintf(os.Stdout, "\n")
+}
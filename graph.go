@@ -0,0 +1,221 @@
+/**
+ * Copyright (c) 2016-present, Facebook, Inc.
+ * All rights reserved.
+ *
+ * This source code is licensed under the BSD-style license found in the
+ * LICENSE file in the root directory of this source tree. An additional grant
+ * of patent rights can be found in the PATENTS file in the same directory.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// GraphNode is a responder seen at some ttl, along with the flows crossing it
+type GraphNode struct {
+	TTL  int
+	Name string
+	// the source ports crossing the node
+	Flows []int
+	// probes sent to the node and answered by it, over all flows
+	Sent int
+	Rcvd int
+	// number of links coming in from the previous ttl, and going out to the next one
+	InDegree  int
+	OutDegree int
+	// how the node spreads the traffic over its next hops, if classified
+	Balancing string
+}
+
+// GraphEdge is a link between responders at consecutive ttls, From being at the given ttl
+type GraphEdge struct {
+	TTL  int
+	From string
+	To   string
+	// the source ports taking the link
+	Flows []int
+	// probes sent across the link to its far end and answered by it, over all flows taking the link
+	Sent int
+	Rcvd int
+	// the loss added by the link: how much lower the hit rate of the far end is, compared to the near end
+	Loss float64
+}
+
+// Graph is the load-balanced topology towards the target, merged from the paths of all flows
+type Graph struct {
+	Nodes []*GraphNode
+	Edges []*GraphEdge
+}
+
+// Tell if the hop name stands for no responder at all: a ttl that never answered, or a non-responding hop
+func unresolvedHop(name string) bool {
+	return name == "?" || name == nonResponding
+}
+
+//
+// Name a hop for merging the paths of several flows. A ttl that never answered or a non-responding hop may be
+// any router, so such hops are told apart by the source port they were seen on rather than merged into one
+//
+func mergedHopName(name string, srcPort int) string {
+	if unresolvedHop(name) {
+		return fmt.Sprintf("%s (port %d)", name, srcPort)
+	}
+	return name
+}
+
+//
+// Merge the hop vectors of all the flows into a DAG of responders and links. Every node is keyed by
+// its ttl and name, so that the same router seen at different distances shows up as distinct nodes,
+// and ECMP diamonds show up as nodes with more than one next hop converging further down. The hops
+// without a responder stay apart per source port, they would make up convergence points otherwise
+//
+func buildGraph(sent, rcvd map[int] /* src port */ []int, hops map[int] /* src port */ []string) *Graph {
+	type nodeKey struct {
+		ttl  int
+		name string
+	}
+	type edgeKey struct {
+		ttl      int
+		from, to string
+	}
+	type counts struct {
+		sentFrom, rcvdFrom, sentTo, rcvdTo int
+	}
+
+	nodes := make(map[nodeKey]*GraphNode)
+	edges := make(map[edgeKey]*GraphEdge)
+	edgeCounts := make(map[edgeKey]*counts)
+
+	var ports []int
+	for srcPort := range hops {
+		ports = append(ports, srcPort)
+	}
+	sort.Ints(ports)
+
+	for _, srcPort := range ports {
+		var path []string
+		for _, name := range hops[srcPort] {
+			path = append(path, mergedHopName(name, srcPort))
+		}
+		for i, name := range path {
+			if i >= len(sent[srcPort]) || sent[srcPort][i] == 0 {
+				continue
+			}
+			key := nodeKey{ttl: i + 1, name: name}
+			node := nodes[key]
+			if node == nil {
+				node = &GraphNode{TTL: i + 1, Name: name}
+				nodes[key] = node
+			}
+			node.Flows = append(node.Flows, srcPort)
+			node.Sent += sent[srcPort][i]
+			node.Rcvd += rcvd[srcPort][i]
+
+			if i == 0 || sent[srcPort][i-1] == 0 {
+				continue
+			}
+			ekey := edgeKey{ttl: i, from: path[i-1], to: name}
+			edge := edges[ekey]
+			if edge == nil {
+				edge = &GraphEdge{TTL: i, From: path[i-1], To: name}
+				edges[ekey] = edge
+				edgeCounts[ekey] = &counts{}
+				nodes[nodeKey{ttl: i, name: path[i-1]}].OutDegree++
+				node.InDegree++
+			}
+			edge.Flows = append(edge.Flows, srcPort)
+			c := edgeCounts[ekey]
+			c.sentFrom += sent[srcPort][i-1]
+			c.rcvdFrom += rcvd[srcPort][i-1]
+			c.sentTo += sent[srcPort][i]
+			c.rcvdTo += rcvd[srcPort][i]
+		}
+	}
+
+	graph := &Graph{}
+	for _, node := range nodes {
+		graph.Nodes = append(graph.Nodes, node)
+	}
+	for key, edge := range edges {
+		c := edgeCounts[key]
+		edge.Sent = c.sentTo
+		edge.Rcvd = c.rcvdTo
+		if c.sentFrom > 0 && c.sentTo > 0 && c.rcvdFrom > 0 {
+			hitFrom := float64(c.rcvdFrom) / float64(c.sentFrom)
+			hitTo := float64(c.rcvdTo) / float64(c.sentTo)
+			if hitTo < hitFrom {
+				edge.Loss = 1 - hitTo/hitFrom
+			}
+		}
+		graph.Edges = append(graph.Edges, edge)
+	}
+	sort.Sort(nodesByTTL(graph.Nodes))
+	sort.Sort(edgesByTTL(graph.Edges))
+
+	return graph
+}
+
+type nodesByTTL []*GraphNode
+
+func (n nodesByTTL) Len() int      { return len(n) }
+func (n nodesByTTL) Swap(i, j int) { n[i], n[j] = n[j], n[i] }
+func (n nodesByTTL) Less(i, j int) bool {
+	if n[i].TTL != n[j].TTL {
+		return n[i].TTL < n[j].TTL
+	}
+	return n[i].Name < n[j].Name
+}
+
+type edgesByTTL []*GraphEdge
+
+func (e edgesByTTL) Len() int      { return len(e) }
+func (e edgesByTTL) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e edgesByTTL) Less(i, j int) bool {
+	if e[i].TTL != e[j].TTL {
+		return e[i].TTL < e[j].TTL
+	}
+	if e[i].From != e[j].From {
+		return e[i].From < e[j].From
+	}
+	return e[i].To < e[j].To
+}
+
+//
+// print the graph: the nodes with their fan-out and convergence, and the links with their loss
+//
+func printGraph(graph *Graph) {
+	nodes := tablewriter.NewWriter(os.Stdout)
+	nodes.SetHeader([]string{"TTL", "node", "flows", "sent/rcvd", "in", "out", "role", "balancing"})
+	for _, node := range graph.Nodes {
+		var role string
+		switch {
+		case node.OutDegree > 1 && node.InDegree > 1:
+			role = "convergence, fan-out"
+		case node.OutDegree > 1:
+			role = "fan-out"
+		case node.InDegree > 1:
+			role = "convergence"
+		}
+		nodes.Append([]string{fmt.Sprintf("%d", node.TTL), node.Name, fmt.Sprintf("%d", len(node.Flows)),
+			fmt.Sprintf("%02d/%02d", node.Sent, node.Rcvd), fmt.Sprintf("%d", node.InDegree), fmt.Sprintf("%d", node.OutDegree), role, node.Balancing})
+	}
+
+	edges := tablewriter.NewWriter(os.Stdout)
+	edges.SetHeader([]string{"TTL", "from", "to", "flows", "sent/rcvd", "loss"})
+	for _, edge := range graph.Edges {
+		edges.Append([]string{fmt.Sprintf("%d", edge.TTL), edge.From, edge.To, fmt.Sprintf("%d", len(edge.Flows)),
+			fmt.Sprintf("%02d/%02d", edge.Sent, edge.Rcvd), fmt.Sprintf("%.0f%%", 100*edge.Loss)})
+	}
+
+	fmt.Fprintf(os.Stdout, "Graph nodes:\n")
+	nodes.Render()
+	fmt.Fprintf(os.Stdout, "\nGraph links:\n")
+	edges.Render()
+	fmt.Fprintf(os.Stdout, "\n")
+}
@@ -0,0 +1,120 @@
+/**
+ * Copyright (c) 2016-present, Facebook, Inc.
+ * All rights reserved.
+ *
+ * This source code is licensed under the BSD-style license found in the
+ * LICENSE file in the root directory of this source tree. An additional grant
+ * of patent rights can be found in the PATENTS file in the same directory.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"syscall"
+)
+
+//
+// ICMP echo message types
+//
+const (
+	icmpv4EchoRequest = 8
+	icmpv4EchoReply   = 0
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+)
+
+// the echo payload carries the flow id followed by the checksum fixup word
+const icmpEchoPayloadSize int = 4
+
+// ICMPEchoHeader defines the ICMP echo request/reply header struct
+type ICMPEchoHeader struct {
+	Type       uint8
+	Code       uint8
+	Checksum   uint16
+	Identifier uint16
+	Sequence   uint16
+}
+
+//
+// create & serialize an ICMP echo request probe (header + payload). Load balancers that
+// look past the IP header only see the first 4 bytes of ICMP, so the checksum is the flow
+// identifier: it stays constant for a given flow, while the identifier carries the
+// probe tag and the sequence carries the ttl, with the check byte of the probe above it. The payload holds a copy of the flow id, so
+// that we can recover it from echo replies, and a fixup word that keeps the checksum
+// neutral to the identifier/sequence changes (the Paris traceroute trick)
+//
+func makeICMPEchoPacket(af string, srcAddr, dstAddr *net.IP, probe Probe) []byte {
+	flow := probe.srcPort
+	ICMPEchoHeader := ICMPEchoHeader{
+		Code:       0,
+		Checksum:   0,
+		Identifier: uint16(probe.tag),
+		Sequence:   uint16(probeCheck(probe)<<8) | uint16(probe.ttl&0xff),
+	}
+
+	switch {
+	case af == "ip4":
+		ICMPEchoHeader.Type = icmpv4EchoRequest
+	case af == "ip6":
+		ICMPEchoHeader.Type = icmpv6EchoRequest
+	}
+
+	payload := make([]byte, icmpEchoPayloadSize)
+	binary.BigEndian.PutUint16(payload, uint16(flow))
+
+	// checksum of the packet with zero fixup word
+	packet := append(ICMPEchoHeader.Serialize(), payload...)
+	csum := icmpChecksum(af, packet, srcAddr, dstAddr)
+
+	binary.BigEndian.PutUint16(payload[2:], checksumFixup(csum, uint16(flow)))
+	ICMPEchoHeader.Checksum = uint16(flow)
+
+	return append(ICMPEchoHeader.Serialize(), payload...)
+}
+
+// Recover the probe of the given flow from the echo header, and tell if this run has sent it
+func (echo *ICMPEchoHeader) probe(flow int) (Probe, bool) {
+	probe := Probe{srcPort: flow, ttl: int(echo.Sequence & 0xff), tag: uint32(echo.Identifier)}
+	return probe, ownTag(probe.tag) && uint32(echo.Sequence>>8) == probeCheck(probe)
+}
+
+// Parse packet into ICMPEchoHeader structure
+func parseICMPEchoHeader(data []byte) *ICMPEchoHeader {
+	var echo ICMPEchoHeader
+
+	r := bytes.NewReader(data)
+
+	binary.Read(r, binary.BigEndian, &echo.Type)
+	binary.Read(r, binary.BigEndian, &echo.Code)
+	binary.Read(r, binary.BigEndian, &echo.Checksum)
+	binary.Read(r, binary.BigEndian, &echo.Identifier)
+	binary.Read(r, binary.BigEndian, &echo.Sequence)
+
+	return &echo
+}
+
+// Serialize emits raw bytes for the header
+func (echo *ICMPEchoHeader) Serialize() []byte {
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, echo.Type)
+	binary.Write(buf, binary.BigEndian, echo.Code)
+	binary.Write(buf, binary.BigEndian, echo.Checksum)
+	binary.Write(buf, binary.BigEndian, echo.Identifier)
+	binary.Write(buf, binary.BigEndian, echo.Sequence)
+
+	return buf.Bytes()
+}
+
+//
+// ICMP Checksum, ICMPv6 includes the pseudo header while ICMPv4 does not
+//
+func icmpChecksum(af string, data []byte, srcip, dstip *net.IP) uint16 {
+	if af == "ip6" {
+		return pseudoHeaderChecksum(af, syscall.IPPROTO_ICMPV6, data, srcip, dstip)
+	}
+	return internetChecksum(data)
+}
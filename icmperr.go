@@ -0,0 +1,247 @@
+/**
+ * Copyright (c) 2016-present, Facebook, Inc.
+ * All rights reserved.
+ *
+ * This source code is licensed under the BSD-style license found in the
+ * LICENSE file in the root directory of this source tree. An additional grant
+ * of patent rights can be found in the PATENTS file in the same directory.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// what an ICMP error tells about the probe it quotes, and how the probes of a source port ended
+const (
+	// the probe was forwarded until its ttl ran out
+	outcomeTransit = "transit"
+	// the probe was forwarded and the router just let us know about it
+	outcomeNotice = "notice"
+	// the probe made it to the target
+	outcomeReached = "reached"
+	// a firewall or a filter on the way rejected the probe
+	outcomeFiltered = "filtered"
+	// there was no route or no host to take the probe to
+	outcomeUnreachable = "unreachable"
+	// the probe did not fit the MTU of the next link
+	outcomeTooBig = "too big"
+	// the probe was discarded for some other reason, e.g. a header the router would not process
+	outcomeDropped = "dropped"
+	// neither the target nor anything stopping the probes answered
+	outcomeNotReached = "not reached"
+)
+
+// ICMPError is the type and code of an ICMP error quoting one of our probes, and what they mean
+type ICMPError struct {
+	Type        int
+	Code        int
+	Description string
+	Outcome     string
+}
+
+type icmpTypeCode struct {
+	icmpType int
+	icmpCode int
+}
+
+type icmpErrorKind struct {
+	description string
+	outcome     string
+}
+
+//
+// The ICMP errors by type and code; the codes not listed here take the entry of their type with code -1.
+// The receivers tell the port unreachable errors sent by the destination of our UDP probes apart, which
+// leaves the ones sent by a router or by the destination of any other probe: that is how most firewalls reject
+//
+var icmpv4Errors = map[icmpTypeCode]icmpErrorKind{
+	{3, -1}:  {"destination unreachable", outcomeUnreachable},
+	{3, 0}:   {"network unreachable", outcomeUnreachable},
+	{3, 1}:   {"host unreachable", outcomeUnreachable},
+	{3, 2}:   {"protocol unreachable", outcomeUnreachable},
+	{3, 3}:   {"port unreachable", outcomeFiltered},
+	{3, 4}:   {"fragmentation needed", outcomeTooBig},
+	{3, 5}:   {"source route failed", outcomeUnreachable},
+	{3, 6}:   {"network unknown", outcomeUnreachable},
+	{3, 7}:   {"host unknown", outcomeUnreachable},
+	{3, 8}:   {"source host isolated", outcomeFiltered},
+	{3, 9}:   {"network administratively prohibited", outcomeFiltered},
+	{3, 10}:  {"host administratively prohibited", outcomeFiltered},
+	{3, 11}:  {"network unreachable for TOS", outcomeUnreachable},
+	{3, 12}:  {"host unreachable for TOS", outcomeUnreachable},
+	{3, 13}:  {"communication administratively prohibited", outcomeFiltered},
+	{3, 14}:  {"host precedence violation", outcomeFiltered},
+	{3, 15}:  {"precedence cutoff in effect", outcomeFiltered},
+	{4, -1}:  {"source quench", outcomeNotice},
+	{4, 0}:   {"source quench", outcomeNotice},
+	{5, -1}:  {"redirect", outcomeNotice},
+	{5, 0}:   {"redirect for network", outcomeNotice},
+	{5, 1}:   {"redirect for host", outcomeNotice},
+	{5, 2}:   {"redirect for TOS and network", outcomeNotice},
+	{5, 3}:   {"redirect for TOS and host", outcomeNotice},
+	{11, -1}: {"time exceeded", outcomeDropped},
+	{11, 0}:  {"time to live exceeded in transit", outcomeTransit},
+	{11, 1}:  {"fragment reassembly time exceeded", outcomeDropped},
+	{12, -1}: {"parameter problem", outcomeDropped},
+	{12, 0}:  {"parameter problem, pointer indicates the error", outcomeDropped},
+	{12, 1}:  {"parameter problem, missing a required option", outcomeDropped},
+	{12, 2}:  {"parameter problem, bad length", outcomeDropped},
+}
+
+var icmpv6Errors = map[icmpTypeCode]icmpErrorKind{
+	{1, -1}: {"destination unreachable", outcomeUnreachable},
+	{1, 0}:  {"no route to destination", outcomeUnreachable},
+	{1, 1}:  {"communication administratively prohibited", outcomeFiltered},
+	{1, 2}:  {"beyond scope of source address", outcomeUnreachable},
+	{1, 3}:  {"address unreachable", outcomeUnreachable},
+	{1, 4}:  {"port unreachable", outcomeFiltered},
+	{1, 5}:  {"source address failed ingress/egress policy", outcomeFiltered},
+	{1, 6}:  {"reject route to destination", outcomeFiltered},
+	{1, 7}:  {"error in source routing header", outcomeUnreachable},
+	{2, -1}: {"packet too big", outcomeTooBig},
+	{2, 0}:  {"packet too big", outcomeTooBig},
+	{3, -1}: {"time exceeded", outcomeDropped},
+	{3, 0}:  {"hop limit exceeded in transit", outcomeTransit},
+	{3, 1}:  {"fragment reassembly time exceeded", outcomeDropped},
+	{4, -1}: {"parameter problem", outcomeDropped},
+	{4, 0}:  {"erroneous header field encountered", outcomeDropped},
+	{4, 1}:  {"unrecognized next header type encountered", outcomeDropped},
+	{4, 2}:  {"unrecognized IPv6 option encountered", outcomeDropped},
+}
+
+// Decode the ICMP type and code, or return nil if that is not an error message
+func newICMPError(af string, icmpType, icmpCode int) *ICMPError {
+	kinds := icmpv4Errors
+	if af == "ip6" {
+		kinds = icmpv6Errors
+	}
+	kind, ok := kinds[icmpTypeCode{icmpType, icmpCode}]
+	if !ok {
+		if kind, ok = kinds[icmpTypeCode{icmpType, -1}]; !ok {
+			return nil
+		}
+		kind.description = fmt.Sprintf("%s, code %d", kind.description, icmpCode)
+	}
+	return &ICMPError{Type: icmpType, Code: icmpCode, Description: kind.description, Outcome: kind.outcome}
+}
+
+// Tell if the error means the probe went no further than the router sending it
+func (e *ICMPError) terminal() bool {
+	return e.Outcome != outcomeTransit && e.Outcome != outcomeNotice
+}
+
+func (e *ICMPError) String() string {
+	return fmt.Sprintf("%s (%d/%d)", e.Description, e.Type, e.Code)
+}
+
+// PathOutcome tells how the probes of a source port ended
+type PathOutcome struct {
+	Outcome string
+	// the ttl and the hop the probes ended at, and the error that stopped them; zero if they just went unanswered
+	TTL   int
+	Hop   string
+	Error *ICMPError
+}
+
+//
+// Tell how the probes of a source port ended from its last hop, once the path is cut at the target
+// or at the first hop stopping the probes: an error that stops the probes wins even if the target sent it
+//
+func pathOutcome(hops []string, icmpErrors []*ICMPError, target string) *PathOutcome {
+	last := len(hops) - 1
+	switch {
+	case last < 0:
+		return &PathOutcome{Outcome: outcomeNotReached}
+	case icmpErrors[last] != nil && icmpErrors[last].terminal():
+		return &PathOutcome{Outcome: icmpErrors[last].Outcome, TTL: last + 1, Hop: hops[last], Error: icmpErrors[last]}
+	case hops[last] == target:
+		return &PathOutcome{Outcome: outcomeReached, TTL: last + 1, Hop: hops[last]}
+	}
+	return &PathOutcome{Outcome: outcomeNotReached}
+}
+
+// PathEnd is where the probes of some flows ended, and how
+type PathEnd struct {
+	PathOutcome
+	// the source ports ending there
+	Flows []int
+}
+
+// Group the source ports ending the same way at the same hop
+func summarizeOutcomes(outcomes map[int] /* src port */ *PathOutcome) []*PathEnd {
+	ends := make(map[string]*PathEnd)
+	for srcPort, outcome := range outcomes {
+		key := fmt.Sprintf("%s %d %s", outcome.Outcome, outcome.TTL, outcome.Hop)
+		if outcome.Error != nil {
+			key += " " + outcome.Error.String()
+		}
+		if ends[key] == nil {
+			ends[key] = &PathEnd{PathOutcome: *outcome}
+		}
+		ends[key].Flows = append(ends[key].Flows, srcPort)
+	}
+
+	var result []*PathEnd
+	for _, end := range ends {
+		sort.Ints(end.Flows)
+		result = append(result, end)
+	}
+	sort.Sort(endsByFlows(result))
+
+	return result
+}
+
+// Tell if some of the flows were stopped short of the target by an error
+func stoppedFlows(ends []*PathEnd) bool {
+	for _, end := range ends {
+		if end.Error != nil {
+			return true
+		}
+	}
+	return false
+}
+
+type endsByFlows []*PathEnd
+
+func (e endsByFlows) Len() int      { return len(e) }
+func (e endsByFlows) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e endsByFlows) Less(i, j int) bool {
+	if len(e[i].Flows) != len(e[j].Flows) {
+		return len(e[i].Flows) > len(e[j].Flows)
+	}
+	return e[i].Flows[0] < e[j].Flows[0]
+}
+
+//
+// print where the probes of every group of flows ended: at the target, at a firewall or a router
+// rejecting them with an ICMP error, or nowhere in particular
+//
+func printOutcomes(ends []*PathEnd) {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"outcome", "TTL", "hop", "ICMP error", "flows", "src ports"})
+	for _, end := range ends {
+		ttl, hop, icmpError := "-", "-", "-"
+		if end.TTL > 0 {
+			ttl, hop = fmt.Sprintf("%d", end.TTL), end.Hop
+		}
+		if end.Error != nil {
+			icmpError = end.Error.String()
+		}
+		var ports []string
+		for _, flow := range end.Flows {
+			ports = append(ports, fmt.Sprintf("%d", flow))
+		}
+		table.Append([]string{end.Outcome, ttl, hop, icmpError, fmt.Sprintf("%d", len(end.Flows)), strings.Join(ports, ", ")})
+	}
+
+	fmt.Fprintf(os.Stdout, "Path outcomes:\n")
+	table.Render()
+	fmt.Fprintf(os.Stdout, "\n")
+}
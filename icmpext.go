@@ -0,0 +1,270 @@
+/**
+ * Copyright (c) 2016-present, Facebook, Inc.
+ * All rights reserved.
+ *
+ * This source code is licensed under the BSD-style license found in the
+ * LICENSE file in the root directory of this source tree. An additional grant
+ * of patent rights can be found in the PATENTS file in the same directory.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	// RFC 4884 extension structure version
+	icmpExtVersion = 2
+	// the extension header: version, reserved bits and checksum
+	icmpExtHdrSize int = 4
+	// the object header: length, class-num and c-type
+	icmpExtObjHdrSize int = 4
+	// the original datagram is padded to at least that many bytes when extensions follow it; the
+	// implementations predating RFC 4884 leave the length field zero and always quote that many bytes
+	icmpExtOriginalSize int = 128
+	// RFC 4950 MPLS label stack object, incoming stack
+	icmpExtClassMPLS    = 1
+	icmpExtMPLSIncoming = 1
+	// a label stack entry
+	mplsEntrySize int = 4
+	// RFC 5837 interface information object
+	icmpExtClassInterface = 2
+)
+
+// the bits of the c-type of an interface information object, telling what the object describes and what it carries
+const (
+	ifInfoRoleShift   = 6
+	ifInfoHasIfIndex  = 0x08
+	ifInfoHasAddr     = 0x04
+	ifInfoHasName     = 0x02
+	ifInfoHasMTU      = 0x01
+	ifInfoAFIIPv4     = 1
+	ifInfoAFIIPv6     = 2
+	ifInfoMaxNameSize = 64
+)
+
+// the interfaces an interface information object may describe, by role
+var ifInfoRoles = []string{"incoming", "incoming sub-IP", "outgoing", "next hop"}
+
+// MPLSLabel is an entry of the MPLS label stack of a probe, as received by the LSR it expired at
+type MPLSLabel struct {
+	Label int
+	// traffic class, formerly known as the experimental bits
+	TC int
+	// bottom of stack
+	S   bool
+	TTL int
+}
+
+func (l MPLSLabel) String() string {
+	return fmt.Sprintf("L=%d,TC=%d,TTL=%d", l.Label, l.TC, l.TTL)
+}
+
+// Format the label stack for the hop tables, top label first
+func mplsStackString(labels []MPLSLabel) string {
+	var entries []string
+	for _, l := range labels {
+		entries = append(entries, l.String())
+	}
+	return "MPLS " + strings.Join(entries, " / ")
+}
+
+// InterfaceInfo describes an interface of the router sending an ICMP error, typically the one the probe came in on.
+// Routers include only some of the fields, the ones left out are zero
+type InterfaceInfo struct {
+	Role    string
+	IfIndex int
+	Addr    string
+	Name    string
+	MTU     int
+}
+
+func (i InterfaceInfo) String() string {
+	var fields []string
+	if i.Name != "" {
+		fields = append(fields, i.Name)
+	}
+	if i.IfIndex != 0 {
+		fields = append(fields, fmt.Sprintf("ifIndex %d", i.IfIndex))
+	}
+	if i.Addr != "" {
+		fields = append(fields, i.Addr)
+	}
+	if i.MTU != 0 {
+		fields = append(fields, fmt.Sprintf("MTU %d", i.MTU))
+	}
+	return i.Role + " " + strings.Join(fields, ", ")
+}
+
+// icmpExtensions are the objects an ICMP error carries after the original datagram
+type icmpExtensions struct {
+	labels     []MPLSLabel
+	interfaces []InterfaceInfo
+}
+
+// Tell if there is anything worth showing in the extensions
+func (e *icmpExtensions) empty() bool {
+	return e == nil || (len(e.labels) == 0 && len(e.interfaces) == 0)
+}
+
+// Format the extensions to go after the hop name in the hop tables
+func (e *icmpExtensions) annotation() string {
+	var parts []string
+	for _, i := range e.interfaces {
+		parts = append(parts, "["+i.String()+"]")
+	}
+	if len(e.labels) > 0 {
+		parts = append(parts, "["+mplsStackString(e.labels)+"]")
+	}
+	return strings.Join(parts, " ")
+}
+
+// Tell if the ICMP error type may carry RFC 4884 extensions: destination unreachable, time exceeded and parameter problem
+func icmpExtensible(af string, icmpType int) bool {
+	switch {
+	case af == "ip4":
+		return icmpType == 3 || icmpType == 11 || icmpType == 12
+	case af == "ip6":
+		return icmpType == 1 || icmpType == 3
+	}
+	return false
+}
+
+//
+// Find and parse the extension structure following the original datagram in an ICMP error. The length field of
+// the ICMP header tells the size of the original datagram, in 32-bit words for ICMP and 64-bit words for ICMPv6.
+// Without it, we still look for an extension structure right after the first 128 bytes, as the implementations
+// predating RFC 4884 put it there, and take it only if its version and checksum are right. Returns nil if there
+// is no valid extension structure
+//
+func parseICMPExtensions(af string, icmpHdr, payload []byte) *icmpExtensions {
+	if !icmpExtensible(af, int(icmpHdr[0])) {
+		return nil
+	}
+
+	var offset int
+	switch {
+	case af == "ip4":
+		offset = 4 * int(icmpHdr[5])
+	case af == "ip6":
+		offset = 8 * int(icmpHdr[4])
+	}
+	compat := offset == 0
+	switch {
+	case compat:
+		offset = icmpExtOriginalSize
+	case offset < icmpExtOriginalSize:
+		return nil
+	}
+	if len(payload) < offset+icmpExtHdrSize {
+		return nil
+	}
+
+	ext := payload[offset:]
+	if ext[0]>>4 != icmpExtVersion {
+		return nil
+	}
+	// a zero checksum was not computed, which we do not trust without the length field
+	checksum := binary.BigEndian.Uint16(ext[2:])
+	if (checksum != 0 && internetChecksum(ext) != 0) || (checksum == 0 && compat) {
+		return nil
+	}
+
+	var extensions icmpExtensions
+	for objs := ext[icmpExtHdrSize:]; len(objs) >= icmpExtObjHdrSize; {
+		length := int(binary.BigEndian.Uint16(objs))
+		if length < icmpExtObjHdrSize || length > len(objs) {
+			break
+		}
+		class, ctype, data := objs[2], objs[3], objs[icmpExtObjHdrSize:length]
+		switch {
+		case class == icmpExtClassMPLS && ctype == icmpExtMPLSIncoming:
+			extensions.labels = parseMPLSLabels(data)
+		case class == icmpExtClassInterface:
+			if info, ok := parseInterfaceInfo(ctype, data); ok {
+				extensions.interfaces = append(extensions.interfaces, info)
+			}
+		}
+		objs = objs[length:]
+	}
+
+	return &extensions
+}
+
+// Parse the entries of an MPLS label stack object, up to the bottom of the stack
+func parseMPLSLabels(data []byte) []MPLSLabel {
+	var labels []MPLSLabel
+	for i := 0; i+mplsEntrySize <= len(data); i += mplsEntrySize {
+		entry := binary.BigEndian.Uint32(data[i:])
+		label := MPLSLabel{Label: int(entry >> 12), TC: int(entry>>9) & 0x7, S: entry&0x100 != 0, TTL: int(entry & 0xff)}
+		labels = append(labels, label)
+		if label.S {
+			break
+		}
+	}
+	return labels
+}
+
+//
+// Parse an interface information object: the c-type tells the role of the interface and which of the ifIndex,
+// the IP address, the name and the MTU follow, in that order. Returns false if the object is too short for them
+//
+func parseInterfaceInfo(ctype byte, data []byte) (InterfaceInfo, bool) {
+	info := InterfaceInfo{Role: ifInfoRoles[ctype>>ifInfoRoleShift]}
+
+	if ctype&ifInfoHasIfIndex != 0 {
+		if len(data) < 4 {
+			return info, false
+		}
+		info.IfIndex = int(binary.BigEndian.Uint32(data))
+		data = data[4:]
+	}
+
+	if ctype&ifInfoHasAddr != 0 {
+		// address family, reserved, and the address itself
+		if len(data) < 4 {
+			return info, false
+		}
+		var size int
+		switch binary.BigEndian.Uint16(data) {
+		case ifInfoAFIIPv4:
+			size = net.IPv4len
+		case ifInfoAFIIPv6:
+			size = net.IPv6len
+		default:
+			return info, false
+		}
+		if len(data) < 4+size {
+			return info, false
+		}
+		info.Addr = net.IP(data[4 : 4+size]).String()
+		data = data[4+size:]
+	}
+
+	if ctype&ifInfoHasName != 0 {
+		// the length includes the length octet itself, the name is padded with zeros
+		if len(data) < 1 {
+			return info, false
+		}
+		size := int(data[0])
+		if size < 1 || size > ifInfoMaxNameSize || size > len(data) {
+			return info, false
+		}
+		info.Name = string(bytes.TrimRight(data[1:size], "\x00"))
+		data = data[size:]
+	}
+
+	if ctype&ifInfoHasMTU != 0 {
+		if len(data) < 4 {
+			return info, false
+		}
+		info.MTU = int(binary.BigEndian.Uint32(data))
+	}
+
+	return info, true
+}
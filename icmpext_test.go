@@ -0,0 +1,153 @@
+/**
+ * Copyright (c) 2016-present, Facebook, Inc.
+ * All rights reserved.
+ *
+ * This source code is licensed under the BSD-style license found in the
+ * LICENSE file in the root directory of this source tree. An additional grant
+ * of patent rights can be found in the PATENTS file in the same directory.
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// the IPv4 and UDP headers of a probe to 10.9.9.10, as quoted back in the ICMP errors below
+const quotedProbe = "45000026c3b5000001118d1b0a0000020a09090a8000829a0012d1c5"
+
+// RFC 4950 label stack of two entries: label 16001 with TTL 1, then label 299824 with TC 5, TTL 1 and bottom of stack
+const (
+	extMPLS = "200076d5" + "000c0101" + "03e81001" + "49330b01"
+	// the same, without the checksum
+	extMPLSNoChecksum = "20000000" + "000c0101" + "03e81001" + "49330b01"
+	// the object claims more entries than the message carries
+	extMPLSTruncated = "200076cd" + "00140101" + "03e81001" + "49330b01"
+	// the checksum does not match
+	extMPLSBadChecksum = "200076d6" + "000c0101" + "03e81001" + "49330b01"
+)
+
+var mplsStack = []MPLSLabel{{Label: 16001, TTL: 1}, {Label: 299824, TC: 5, S: true, TTL: 1}}
+
+// RFC 5837 incoming interface, with its ifIndex, IPv4 address, name and MTU, followed by the label stack above
+const (
+	extInterfaceMPLS = "20000f44" + "0020020f" + ifInfoIncoming + "000c0101" + "03e81001" + "49330b01"
+	ifInfoIncoming   = "00000205" + "00010000" + "0a000302" + "0c78652d302f302f312e3000" + "00002328"
+)
+
+var incomingInterface = InterfaceInfo{Role: "incoming", IfIndex: 517, Addr: "10.0.3.2", Name: "xe-0/0/1.0", MTU: 9000}
+
+// Assemble the payload of an ICMP error: the quoted probe padded to the given size, followed by the extensions
+func icmpPayload(t *testing.T, size int, ext string) []byte {
+	quote, err := hex.DecodeString(quotedProbe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extensions, err := hex.DecodeString(ext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := make([]byte, size)
+	copy(payload, quote)
+	return append(payload, extensions...)
+}
+
+func TestParseICMPExtensions(t *testing.T) {
+	tests := []struct {
+		name string
+		af   string
+		// the ICMP header, type, code and the length of the original datagram
+		icmpType, icmpCode, length int
+		size                       int
+		ext                        string
+		// nil if no valid extension structure should be found
+		want *icmpExtensions
+	}{
+		{"time exceeded", "ip4", 11, 0, 32, 128, extMPLS, &icmpExtensions{labels: mplsStack}},
+		{"longer original datagram", "ip4", 11, 0, 36, 144, extMPLS, &icmpExtensions{labels: mplsStack}},
+		{"destination unreachable", "ip4", 3, 3, 32, 128, extMPLS, &icmpExtensions{labels: mplsStack}},
+		{"ICMPv6 time exceeded", "ip6", 3, 0, 16, 128, extMPLS, &icmpExtensions{labels: mplsStack}},
+		{"compat", "ip4", 11, 0, 0, 128, extMPLS, &icmpExtensions{labels: mplsStack}},
+		{"compat without checksum", "ip4", 11, 0, 0, 128, extMPLSNoChecksum, nil},
+		{"without checksum", "ip4", 11, 0, 32, 128, extMPLSNoChecksum, &icmpExtensions{labels: mplsStack}},
+		{"bad checksum", "ip4", 11, 0, 32, 128, extMPLSBadChecksum, nil},
+		{"truncated object", "ip4", 11, 0, 32, 128, extMPLSTruncated, &icmpExtensions{}},
+		{"truncated header", "ip4", 11, 0, 32, 128, extMPLS[:4], nil},
+		{"no extensions", "ip4", 11, 0, 0, 128, "", nil},
+		{"original datagram too short", "ip4", 11, 0, 20, 80, extMPLS, nil},
+		{"echo reply", "ip4", 0, 0, 32, 128, extMPLS, nil},
+		{"interface and label stack", "ip4", 11, 0, 32, 128, extInterfaceMPLS,
+			&icmpExtensions{labels: mplsStack, interfaces: []InterfaceInfo{incomingInterface}}},
+	}
+
+	for _, test := range tests {
+		icmpHdr := []byte{byte(test.icmpType), byte(test.icmpCode), 0, 0, 0, 0, 0, 0}
+		switch {
+		case test.af == "ip4":
+			icmpHdr[5] = byte(test.length)
+		case test.af == "ip6":
+			icmpHdr[4] = byte(test.length)
+		}
+		got := parseICMPExtensions(test.af, icmpHdr, icmpPayload(t, test.size, test.ext))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseMPLSLabels(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []MPLSLabel
+	}{
+		{"two entries", "03e8100149330b01", mplsStack},
+		{"stops at the bottom of stack", "49330b0103e81001", []MPLSLabel{mplsStack[1]}},
+		{"partial entry", "03e8100149330b", []MPLSLabel{mplsStack[0]}},
+		{"empty", "", nil},
+	}
+
+	for _, test := range tests {
+		data, err := hex.DecodeString(test.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := parseMPLSLabels(data); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseInterfaceInfo(t *testing.T) {
+	tests := []struct {
+		name  string
+		ctype byte
+		data  string
+		want  InterfaceInfo
+		ok    bool
+	}{
+		{"all fields", 0x0f, ifInfoIncoming, incomingInterface, true},
+		{"outgoing ifIndex", 0x88, "00000205", InterfaceInfo{Role: "outgoing", IfIndex: 517}, true},
+		{"next hop IPv6 address", 0xc4, "00020000" + "20010db8000000000000000000000001", InterfaceInfo{Role: "next hop", Addr: "2001:db8::1"}, true},
+		{"incoming sub-IP name", 0x42, "08657468302e3130", InterfaceInfo{Role: "incoming sub-IP", Name: "eth0.10"}, true},
+		{"truncated ifIndex", 0x08, "000002", InterfaceInfo{Role: "incoming"}, false},
+		{"truncated address", 0x04, "000100000a0003", InterfaceInfo{Role: "incoming"}, false},
+		{"unknown address family", 0x04, "000300000a000302", InterfaceInfo{Role: "incoming"}, false},
+		{"name longer than the object", 0x02, "0c78652d30", InterfaceInfo{Role: "incoming"}, false},
+		{"empty name length", 0x02, "00000000", InterfaceInfo{Role: "incoming"}, false},
+		{"truncated MTU", 0x09, "00000205" + "0000", InterfaceInfo{Role: "incoming", IfIndex: 517}, false},
+	}
+
+	for _, test := range tests {
+		data, err := hex.DecodeString(test.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := parseInterfaceInfo(test.ctype, data)
+		if ok != test.ok || (ok && got != test.want) {
+			t.Errorf("%s: got %+v, %v, want %+v, %v", test.name, got, ok, test.want, test.ok)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+/**
+ * Copyright (c) 2016-present, Facebook, Inc.
+ * All rights reserved.
+ *
+ * This source code is licensed under the BSD-style license found in the
+ * LICENSE file in the root directory of this source tree. An additional grant
+ * of patent rights can be found in the PATENTS file in the same directory.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// IPv4 header without and with the most options the header length field allows
+	ipv4MinHdrSize int = 20
+	ipv4MaxHdrSize int = 60
+	ipv6HdrSize    int = 40
+	// large enough for any ICMP error we may get, the quoted packet and its extensions included
+	recvBufferSize int = 4096
+)
+
+// the reasons the receivers reject a packet
+var (
+	errTruncated         = errors.New("truncated")
+	errBadIPHeader       = errors.New("bad IP header")
+	errInnerChecksum     = errors.New("bad inner IP checksum")
+	errInnerFragment     = errors.New("inner non-first fragment")
+	errInnerProtocol     = errors.New("unexpected inner protocol")
+	errInnerSource       = errors.New("foreign inner source")
+	errInnerDestination  = errors.New("foreign inner destination")
+	errTransportTooShort = errors.New("truncated transport header")
+)
+
+// dropStats counts the packets the receivers threw away, per reason
+type dropStats struct {
+	sync.Mutex
+	dropped map[string]int
+}
+
+func newDropStats() *dropStats {
+	return &dropStats{dropped: make(map[string]int)}
+}
+
+// Count a packet rejected for the given reason
+func (d *dropStats) drop(reason error) {
+	d.Lock()
+	defer d.Unlock()
+	d.dropped[reason.Error()]++
+}
+
+// The total number of packets dropped
+func (d *dropStats) total() int {
+	d.Lock()
+	defer d.Unlock()
+	total := 0
+	for _, count := range d.dropped {
+		total += count
+	}
+	return total
+}
+
+// String lists the drop counts, sorted by reason
+func (d *dropStats) String() string {
+	d.Lock()
+	defer d.Unlock()
+	var reasons []string
+	for reason := range d.dropped {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	var counts []string
+	for _, reason := range reasons {
+		counts = append(counts, fmt.Sprintf("%d %s", d.dropped[reason], reason))
+	}
+	return strings.Join(counts, ", ")
+}
+
+//
+// Tell the length of the IPv4 header at the start of the packet from its IHL field,
+// making sure it is an IPv4 header and that the whole of it was received
+//
+func ipv4HeaderLen(packet []byte) (int, error) {
+	if len(packet) < ipv4MinHdrSize {
+		return 0, errTruncated
+	}
+	if packet[0]>>4 != 4 {
+		return 0, errBadIPHeader
+	}
+	hdrLen := int(packet[0]&0x0f) * 4
+	switch {
+	case hdrLen < ipv4MinHdrSize:
+		return 0, errBadIPHeader
+	case hdrLen > len(packet):
+		return 0, errTruncated
+	}
+	return hdrLen, nil
+}
+
+// innerHeader is the header of our own packet quoted back in an ICMP error
+type innerHeader struct {
+	// the length of the header, options included; the transport header follows
+	size  int
+	proto int
+	src   net.IP
+	dst   net.IP
+}
+
+//
+// Parse the IP header of the packet quoted in an ICMP error, which must be followed by the first
+// 8 bytes of its transport header. The IPv4 header checksum is verified, and non-first fragments
+// are rejected since they carry no transport header. We never send IPv6 extension headers
+//
+func parseInnerHeader(af string, quote []byte) (*innerHeader, error) {
+	const transportHdrSize int = 8
+
+	var inner innerHeader
+	switch {
+	case af == "ip4":
+		hdrLen, err := ipv4HeaderLen(quote)
+		if err != nil {
+			return nil, err
+		}
+		if internetChecksum(quote[:hdrLen]) != 0 {
+			return nil, errInnerChecksum
+		}
+		if (int(quote[6])<<8|int(quote[7]))&0x1fff != 0 {
+			return nil, errInnerFragment
+		}
+		inner = innerHeader{size: hdrLen, proto: int(quote[9]), src: net.IP(quote[12:16]), dst: net.IP(quote[16:20])}
+	case af == "ip6":
+		if len(quote) < ipv6HdrSize {
+			return nil, errTruncated
+		}
+		if quote[0]>>4 != 6 {
+			return nil, errBadIPHeader
+		}
+		inner = innerHeader{size: ipv6HdrSize, proto: int(quote[6]), src: net.IP(quote[8:24]), dst: net.IP(quote[24:40])}
+	default:
+		return nil, errBadIPHeader
+	}
+
+	if len(quote) < inner.size+transportHdrSize {
+		return nil, errTransportTooShort
+	}
+	return &inner, nil
+}
+
+//
+// Check the quoted header belongs to one of our probes: sent with the probe protocol,
+// from our source address, to the target or one of the other destinations we probe
+//
+func (inner *innerHeader) validate(proto int, srcAddr *net.IP, dstAddrs []string) error {
+	if inner.proto != proto {
+		return errInnerProtocol
+	}
+	if !inner.src.Equal(*srcAddr) {
+		return errInnerSource
+	}
+	dst := inner.dst.String()
+	for _, addr := range dstAddrs {
+		if addr == dst {
+			return nil
+		}
+	}
+	return errInnerDestination
+}
@@ -0,0 +1,142 @@
+/**
+ * Copyright (c) 2016-present, Facebook, Inc.
+ * All rights reserved.
+ *
+ * This source code is licensed under the BSD-style license found in the
+ * LICENSE file in the root directory of this source tree. An additional grant
+ * of patent rights can be found in the PATENTS file in the same directory.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+)
+
+//
+// Build the IPv4 header of a quoted probe with the given IHL, the options padded with NOPs, and a valid checksum,
+// followed by the 8 bytes of its transport header. The header is cut short when the IHL does not fit the buffer
+//
+func quotedIPv4(ihl int, proto byte, src, dst string, fragment uint16) []byte {
+	size := ihl * 4
+	if size < ipv4MinHdrSize {
+		size = ipv4MinHdrSize
+	}
+	header := make([]byte, size)
+	header[0] = 4<<4 | byte(ihl)
+	binary.BigEndian.PutUint16(header[2:], uint16(size+8))
+	binary.BigEndian.PutUint16(header[6:], fragment)
+	header[8] = 1
+	header[9] = proto
+	copy(header[12:], net.ParseIP(src).To4())
+	copy(header[16:], net.ParseIP(dst).To4())
+	for i := ipv4MinHdrSize; i < size; i++ {
+		header[i] = 1
+	}
+	binary.BigEndian.PutUint16(header[10:], internetChecksum(header))
+	return append(header, 0x80, 0xe8, 0x82, 0x9a, 0x00, 0x0f, 0x12, 0x34)
+}
+
+// Build the IPv6 header of a quoted probe, followed by the 8 bytes of its transport header
+func quotedIPv6(version, proto byte, src, dst string) []byte {
+	header := make([]byte, ipv6HdrSize)
+	header[0] = version << 4
+	binary.BigEndian.PutUint16(header[4:], 8)
+	header[6] = proto
+	header[7] = 1
+	copy(header[8:], net.ParseIP(src))
+	copy(header[24:], net.ParseIP(dst))
+	return append(header, 0x80, 0xe8, 0x82, 0x9a, 0x00, 0x0f, 0x12, 0x34)
+}
+
+func TestIPv4HeaderLen(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		want   int
+		err    error
+	}{
+		{"no options", quotedIPv4(5, syscall.IPPROTO_UDP, "10.0.0.2", "10.9.9.9", 0), 20, nil},
+		{"options", quotedIPv4(7, syscall.IPPROTO_UDP, "10.0.0.2", "10.9.9.9", 0), 28, nil},
+		{"shorter than the minimum header", quotedIPv4(5, syscall.IPPROTO_UDP, "10.0.0.2", "10.9.9.9", 0)[:19], 0, errTruncated},
+		{"IHL below 5", quotedIPv4(4, syscall.IPPROTO_UDP, "10.0.0.2", "10.9.9.9", 0), 0, errBadIPHeader},
+		{"zero IHL", quotedIPv4(0, syscall.IPPROTO_UDP, "10.0.0.2", "10.9.9.9", 0), 0, errBadIPHeader},
+		{"IHL past the buffer", quotedIPv4(15, syscall.IPPROTO_UDP, "10.0.0.2", "10.9.9.9", 0)[:40], 0, errTruncated},
+		{"IPv6 header", quotedIPv6(6, syscall.IPPROTO_UDP, "2001:db8::2", "2001:db8::9"), 0, errBadIPHeader},
+	}
+
+	for _, test := range tests {
+		got, err := ipv4HeaderLen(test.packet)
+		if got != test.want || err != test.err {
+			t.Errorf("%s: got %d, %v, want %d, %v", test.name, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestParseInnerHeader(t *testing.T) {
+	badChecksum := quotedIPv4(5, syscall.IPPROTO_UDP, "10.0.0.2", "10.9.9.9", 0)
+	badChecksum[10] ^= 0xff
+
+	tests := []struct {
+		name  string
+		af    string
+		quote []byte
+		want  *innerHeader
+		err   error
+	}{
+		{"IPv4", "ip4", quotedIPv4(5, syscall.IPPROTO_UDP, "10.0.0.2", "10.9.9.9", 0),
+			&innerHeader{size: 20, proto: syscall.IPPROTO_UDP, src: net.ParseIP("10.0.0.2"), dst: net.ParseIP("10.9.9.9")}, nil},
+		{"IPv4 with options", "ip4", quotedIPv4(6, syscall.IPPROTO_TCP, "10.0.0.2", "10.9.9.9", 0),
+			&innerHeader{size: 24, proto: syscall.IPPROTO_TCP, src: net.ParseIP("10.0.0.2"), dst: net.ParseIP("10.9.9.9")}, nil},
+		{"IPv4 with don't fragment", "ip4", quotedIPv4(5, syscall.IPPROTO_ICMP, "10.0.0.2", "10.9.9.9", 0x4000),
+			&innerHeader{size: 20, proto: syscall.IPPROTO_ICMP, src: net.ParseIP("10.0.0.2"), dst: net.ParseIP("10.9.9.9")}, nil},
+		{"IHL below 5", "ip4", quotedIPv4(3, syscall.IPPROTO_UDP, "10.0.0.2", "10.9.9.9", 0), nil, errBadIPHeader},
+		{"IHL past the buffer", "ip4", quotedIPv4(15, syscall.IPPROTO_UDP, "10.0.0.2", "10.9.9.9", 0)[:36], nil, errTruncated},
+		{"bad checksum", "ip4", badChecksum, nil, errInnerChecksum},
+		{"non-first fragment", "ip4", quotedIPv4(5, syscall.IPPROTO_UDP, "10.0.0.2", "10.9.9.9", 0x2010), nil, errInnerFragment},
+		{"transport header cut short", "ip4", quotedIPv4(6, syscall.IPPROTO_UDP, "10.0.0.2", "10.9.9.9", 0)[:30], nil, errTransportTooShort},
+		{"IPv6", "ip6", quotedIPv6(6, syscall.IPPROTO_UDP, "2001:db8::2", "2001:db8::9"),
+			&innerHeader{size: 40, proto: syscall.IPPROTO_UDP, src: net.ParseIP("2001:db8::2"), dst: net.ParseIP("2001:db8::9")}, nil},
+		{"IPv6 header cut short", "ip6", quotedIPv6(6, syscall.IPPROTO_UDP, "2001:db8::2", "2001:db8::9")[:39], nil, errTruncated},
+		{"IPv6 transport header cut short", "ip6", quotedIPv6(6, syscall.IPPROTO_UDP, "2001:db8::2", "2001:db8::9")[:44], nil, errTransportTooShort},
+		{"IPv4 header quoted by IPv6", "ip6", append(quotedIPv4(5, syscall.IPPROTO_UDP, "10.0.0.2", "10.9.9.9", 0), make([]byte, 20)...), nil, errBadIPHeader},
+	}
+
+	for _, test := range tests {
+		got, err := parseInnerHeader(test.af, test.quote)
+		switch {
+		case err != test.err:
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+		case got == nil && test.want == nil:
+		case got == nil || test.want == nil || got.size != test.want.size || got.proto != test.want.proto ||
+			!got.src.Equal(test.want.src) || !got.dst.Equal(test.want.dst):
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestValidateInnerHeader(t *testing.T) {
+	srcAddr := net.ParseIP("10.0.0.2")
+	dstAddrs := []string{"10.9.9.9", "10.9.9.8"}
+
+	tests := []struct {
+		name  string
+		inner innerHeader
+		err   error
+	}{
+		{"our probe", innerHeader{size: 20, proto: syscall.IPPROTO_UDP, src: net.ParseIP("10.0.0.2"), dst: net.ParseIP("10.9.9.9")}, nil},
+		{"probe to another destination", innerHeader{size: 20, proto: syscall.IPPROTO_UDP, src: net.ParseIP("10.0.0.2"), dst: net.ParseIP("10.9.9.8")}, nil},
+		{"wrong protocol", innerHeader{size: 20, proto: syscall.IPPROTO_TCP, src: net.ParseIP("10.0.0.2"), dst: net.ParseIP("10.9.9.9")}, errInnerProtocol},
+		{"wrong source", innerHeader{size: 20, proto: syscall.IPPROTO_UDP, src: net.ParseIP("10.0.0.3"), dst: net.ParseIP("10.9.9.9")}, errInnerSource},
+		{"wrong destination", innerHeader{size: 20, proto: syscall.IPPROTO_UDP, src: net.ParseIP("10.0.0.2"), dst: net.ParseIP("10.9.9.7")}, errInnerDestination},
+	}
+
+	for _, test := range tests {
+		if err := test.inner.validate(syscall.IPPROTO_UDP, &srcAddr, dstAddrs); err != test.err {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+/**
+ * Copyright (c) 2016-present, Facebook, Inc.
+ * All rights reserved.
+ *
+ * This source code is licensed under the BSD-style license found in the
+ * LICENSE file in the root directory of this source tree. An additional grant
+ * of patent rights can be found in the PATENTS file in the same directory.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+const (
+	// a path is only compared against this many other paths sharing the hop, or more
+	minLatencySiblings = 2
+	// ... and only hops with that many RTT samples are considered
+	minLatencySamples = 5
+	// how many (normalized) median absolute deviations away from the siblings is anomalous
+	latencyMADFactor = 3.0
+)
+
+// LatencyAnomaly describes a path whose RTT jumps at some hop a lot more than the RTT of its siblings,
+// the paths of other source ports that share the hop. Durations are in nanoseconds
+type LatencyAnomaly struct {
+	TTL int
+	Hop string
+	// the increase of the median RTT at this hop over the previous one
+	Jump time.Duration
+	// the median of the same increase across the siblings
+	SiblingJump time.Duration
+	Siblings    int
+}
+
+//
+// Compare the RTT jump at every hop of every path against the paths of other source ports
+// sharing the same hop at the same ttl. Congested LAG members or overloaded linecards tend
+// to show up as extra latency of some of the paths before anything gets dropped
+//
+func findLatencyAnomalies(hops map[int] /* src port */ []string, rtts map[int] /* src port */ []RTTStats, threshold time.Duration) map[int] /* src port */ []LatencyAnomaly {
+	anomalies := make(map[int][]LatencyAnomaly)
+
+	// RTT jump of the given port at the given ttl index, if we have enough samples
+	jump := func(srcPort, ttl int) (time.Duration, bool) {
+		stats := rtts[srcPort]
+		if ttl >= len(stats) || stats[ttl].Samples < minLatencySamples {
+			return 0, false
+		}
+		if ttl == 0 {
+			return stats[ttl].P50, true
+		}
+		if stats[ttl-1].Samples < minLatencySamples {
+			return 0, false
+		}
+		return stats[ttl].P50 - stats[ttl-1].P50, true
+	}
+
+	// group the ports by the hop they share at every ttl
+	type hopKey struct {
+		ttl  int
+		name string
+	}
+	groups := make(map[hopKey][]int)
+	for srcPort, path := range hops {
+		for ttl, name := range path {
+			if name == "?" {
+				continue
+			}
+			key := hopKey{ttl: ttl, name: name}
+			groups[key] = append(groups[key], srcPort)
+		}
+	}
+
+	for key, ports := range groups {
+		jumps := make(map[int]time.Duration)
+		for _, srcPort := range ports {
+			if j, ok := jump(srcPort, key.ttl); ok {
+				jumps[srcPort] = j
+			}
+		}
+
+		for srcPort, j := range jumps {
+			var siblings []time.Duration
+			for other, o := range jumps {
+				if other != srcPort {
+					siblings = append(siblings, o)
+				}
+			}
+			if len(siblings) < minLatencySiblings {
+				continue
+			}
+
+			median, mad := medianAbsDeviation(siblings)
+			excess := j - median
+			if excess <= threshold || float64(excess) <= latencyMADFactor*float64(mad) {
+				continue
+			}
+
+			anomalies[srcPort] = append(anomalies[srcPort], LatencyAnomaly{
+				TTL:         key.ttl + 1,
+				Hop:         key.name,
+				Jump:        j,
+				SiblingJump: median,
+				Siblings:    len(siblings),
+			})
+		}
+	}
+
+	for _, list := range anomalies {
+		sort.Sort(anomaliesByTTL(list))
+	}
+
+	return anomalies
+}
+
+// Median and normalized median absolute deviation (a robust stand-in for the standard deviation)
+func medianAbsDeviation(samples []time.Duration) (time.Duration, time.Duration) {
+	sorted := make([]time.Duration, len(samples))
+	copy(sorted, samples)
+	sort.Sort(durations(sorted))
+	median := percentile(sorted, 50)
+
+	deviations := make([]time.Duration, len(sorted))
+	for i, s := range sorted {
+		deviations[i] = s - median
+		if deviations[i] < 0 {
+			deviations[i] = -deviations[i]
+		}
+	}
+	sort.Sort(durations(deviations))
+
+	// scale factor for consistency with the standard deviation of normal distribution
+	return median, time.Duration(1.4826 * float64(percentile(deviations, 50)))
+}
+
+type anomaliesByTTL []LatencyAnomaly
+
+func (a anomaliesByTTL) Len() int           { return len(a) }
+func (a anomaliesByTTL) Less(i, j int) bool { return a[i].TTL < a[j].TTL }
+func (a anomaliesByTTL) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+//
+// print the latency anomalies found on the paths
+//
+func printLatencyAnomalies(anomalies map[int] /* src port */ []LatencyAnomaly) {
+	var allPorts []int
+	for srcPort := range anomalies {
+		allPorts = append(allPorts, srcPort)
+	}
+	sort.Ints(allPorts)
+
+	ms := func(d time.Duration) string {
+		return fmt.Sprintf("%.2f", float64(d)/float64(time.Millisecond))
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"port", "TTL", "hop", "rtt jump ms", "sibling jump ms", "siblings"})
+	for _, srcPort := range allPorts {
+		for _, a := range anomalies[srcPort] {
+			table.Append([]string{fmt.Sprintf("%d", srcPort), fmt.Sprintf("%d", a.TTL), a.Hop, ms(a.Jump), ms(a.SiblingJump), fmt.Sprintf("%d", a.Siblings)})
+		}
+	}
+
+	fmt.Fprintf(os.Stdout, "Latency anomalies:\n")
+	table.Render()
+	fmt.Fprintf(os.Stdout, "\n")
+}
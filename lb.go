@@ -0,0 +1,267 @@
+/**
+ * Copyright (c) 2016-present, Facebook, Inc.
+ * All rights reserved.
+ *
+ * This source code is licensed under the BSD-style license found in the
+ * LICENSE file in the root directory of this source tree. An additional grant
+ * of patent rights can be found in the PATENTS file in the same directory.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+const (
+	// the number of flows repeated at every ttl, and how many times each
+	lbFlows   = 8
+	lbRepeats = 4
+	// how many times the probes to the addresses next to the target are sent
+	lbDestinationRepeats = 2
+)
+
+// the ways a node spreads the traffic over its next hops
+const (
+	lbPerFlow        = "per-flow"
+	lbPerPacket      = "per-packet"
+	lbPerDestination = "per-destination"
+)
+
+// Balancer is a node sending our probes to more than one next hop, and the way it picks them
+type Balancer struct {
+	TTL      int
+	Name     string
+	NextHops []string
+	// the flows crossing the node on every probe, and the addresses next to the target doing the same
+	Flows        int
+	Destinations int
+	Balancing    string
+}
+
+// the responders seen at every ttl, indexed by ttl-1
+type lbObservations [][]string
+
+// Record the responder seen at the ttl, once
+func (o lbObservations) add(ttl int, name string) {
+	for _, seen := range o[ttl-1] {
+		if seen == name {
+			return
+		}
+	}
+	o[ttl-1] = append(o[ttl-1], name)
+	sort.Strings(o[ttl-1])
+}
+
+// Tell if the only responder seen at the ttl is the given one
+func (o lbObservations) only(ttl int, name string) bool {
+	return len(o[ttl-1]) == 1 && o[ttl-1][0] == name
+}
+
+//
+// Find the addresses next to the target, flipping the low bits of its last byte, so that they
+// most likely share its route but take a different path through per-destination balancers
+//
+func neighbourAddrs(addr net.IP, n int) []string {
+	var result []string
+	for i := 1; i <= n && i < 256; i++ {
+		neighbour := make(net.IP, len(addr))
+		copy(neighbour, addr)
+		neighbour[len(neighbour)-1] ^= byte(i)
+		result = append(result, neighbour.String())
+	}
+	return result
+}
+
+//
+// Tell how every branching point spreads the traffic. At every ttl we repeat the same flows a few times: a flow
+// that gets answered by different hops while its previous hop stays the same crosses a per-packet balancer, and
+// flows that stay put but disagree with each other cross a per-flow balancer. Nodes where all flows agree are then
+// checked with probes to the addresses next to the target, sent with those flows: another next hop there means
+// the node balances per destination; it is skipped without any destinations given. The start function gives
+// the sender towards a destination. Returns the branching points found and the number of probes spent
+//
+func classifyBalancers(table *ProbeTable, in <-chan interface{}, start func(dest string) senderFunc, target string, dests []string, srcPorts []int, minTTL, maxTTL int) ([]*Balancer, int, error) {
+	flows := srcPorts
+	if len(flows) > lbFlows {
+		flows = flows[:lbFlows]
+	}
+	// every destination takes a flow of its own, so that its probes do not collide in the probe table
+	if len(dests) > len(flows) {
+		dests = dests[:len(flows)]
+	}
+
+	seen := make(map[int] /* src port */ lbObservations)
+	for _, flow := range flows {
+		seen[flow] = make(lbObservations, maxTTL)
+	}
+	destSeen := make(map[string] /* destination */ lbObservations)
+	destFlow := make(map[int] /* src port */ string)
+	for i, dest := range dests {
+		destSeen[dest] = make(lbObservations, maxTTL)
+		destFlow[flows[i]] = dest
+	}
+
+	// all the destinations are probed in one round
+	startDests := func(done <-chan struct{}, ttl int, srcPorts []int, iters int) (chan interface{}, error) {
+		var chans []chan interface{}
+		for i, dest := range dests {
+			c, err := start(dest)(done, ttl, []int{flows[i]}, iters)
+			if err != nil {
+				return nil, err
+			}
+			chans = append(chans, c)
+		}
+		return merge(chans...), nil
+	}
+
+	nameOf := func(resp hopResponse) string {
+		if resp.target {
+			return target
+		}
+		return resp.addr
+	}
+
+	spent := 0
+	for ttl := minTTL; ttl <= maxTTL; ttl++ {
+		responses, sent, err := probeRound(table, in, start(target), ttl, flows, lbRepeats)
+		if err != nil {
+			return nil, spent, err
+		}
+		spent += sent
+		for flow, list := range responses {
+			for _, resp := range list {
+				seen[flow].add(ttl, nameOf(resp))
+			}
+		}
+
+		if len(dests) > 0 {
+			responses, sent, err = probeRound(table, in, startDests, ttl, flows[:len(dests)], lbDestinationRepeats)
+			if err != nil {
+				return nil, spent, err
+			}
+			spent += sent
+			for flow, list := range responses {
+				for _, resp := range list {
+					// the answers of the other addresses themselves tell nothing about the routers
+					if !resp.target {
+						destSeen[destFlow[flow]].add(ttl, resp.addr)
+					}
+				}
+			}
+		}
+
+		reached := true
+		for _, flow := range flows {
+			if !seen[flow].only(ttl, target) {
+				reached = false
+			}
+		}
+		if reached {
+			break
+		}
+	}
+
+	var result []*Balancer
+	for ttl := minTTL + 1; ttl <= maxTTL; ttl++ {
+		// the nodes at the previous ttl, and the flows that crossed them on every probe
+		stable := make(map[string][]int)
+		for _, flow := range flows {
+			if prev := seen[flow][ttl-2]; len(prev) == 1 && prev[0] != target {
+				stable[prev[0]] = append(stable[prev[0]], flow)
+			}
+		}
+
+		for node, nodeFlows := range stable {
+			balancer := &Balancer{TTL: ttl - 1, Name: node, Flows: len(nodeFlows)}
+			nextHops := make(map[string]bool)
+			perPacket := false
+			for _, flow := range nodeFlows {
+				if len(seen[flow][ttl-1]) > 1 {
+					perPacket = true
+				}
+				for _, name := range seen[flow][ttl-1] {
+					nextHops[name] = true
+				}
+			}
+
+			switch {
+			case perPacket:
+				balancer.Balancing = lbPerPacket
+			case len(nextHops) > 1:
+				balancer.Balancing = lbPerFlow
+			case len(nextHops) == 1 && !nextHops[target]:
+				// the other addresses part ways with the target right before it, that is routing and not balancing
+				for _, dest := range dests {
+					if !destSeen[dest].only(ttl-1, node) || len(destSeen[dest][ttl-1]) != 1 {
+						continue
+					}
+					balancer.Destinations++
+					if next := destSeen[dest][ttl-1][0]; !nextHops[next] {
+						nextHops[next] = true
+						balancer.Balancing = lbPerDestination
+					}
+				}
+			}
+			if balancer.Balancing == "" {
+				continue
+			}
+
+			for name := range nextHops {
+				balancer.NextHops = append(balancer.NextHops, name)
+			}
+			sort.Strings(balancer.NextHops)
+			result = append(result, balancer)
+		}
+	}
+	sort.Sort(balancersByTTL(result))
+
+	return result, spent, nil
+}
+
+//
+// Record the balancing of the branching points in the graph. The graph shows the rate-limited
+// hops with an annotation after their name, which still belong to the same node
+//
+func annotateBalancers(graph *Graph, balancers []*Balancer) {
+	for _, node := range graph.Nodes {
+		for _, balancer := range balancers {
+			if node.TTL == balancer.TTL && (node.Name == balancer.Name || strings.HasPrefix(node.Name, balancer.Name+" (")) {
+				node.Balancing = balancer.Balancing
+			}
+		}
+	}
+}
+
+type balancersByTTL []*Balancer
+
+func (b balancersByTTL) Len() int      { return len(b) }
+func (b balancersByTTL) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b balancersByTTL) Less(i, j int) bool {
+	if b[i].TTL != b[j].TTL {
+		return b[i].TTL < b[j].TTL
+	}
+	return b[i].Name < b[j].Name
+}
+
+//
+// print the branching points, and how they balance the traffic
+//
+func printBalancers(balancers []*Balancer) {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"TTL", "node", "next hops", "flows", "destinations", "balancing"})
+	for _, b := range balancers {
+		table.Append([]string{fmt.Sprintf("%d", b.TTL), b.Name, strings.Join(b.NextHops, ", "), fmt.Sprintf("%d", b.Flows),
+			fmt.Sprintf("%d", b.Destinations), b.Balancing})
+	}
+
+	fmt.Fprintf(os.Stdout, "Load balancers:\n")
+	table.Render()
+	fmt.Fprintf(os.Stdout, "\n")
+}
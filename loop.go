@@ -0,0 +1,159 @@
+/**
+ * Copyright (c) 2016-present, Facebook, Inc.
+ * All rights reserved.
+ *
+ * This source code is licensed under the BSD-style license found in the
+ * LICENSE file in the root directory of this source tree. An additional grant
+ * of patent rights can be found in the PATENTS file in the same directory.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// probeLimits is the highest ttl still worth probing per source port, lowered by main and consulted by the senders
+type probeLimits struct {
+	sync.RWMutex
+	maxTTL map[int] /* src port */ int
+}
+
+func newProbeLimits() *probeLimits {
+	return &probeLimits{maxTTL: make(map[int]int)}
+}
+
+// Stop probing the source port above the given ttl
+func (l *probeLimits) limit(srcPort, ttl int) {
+	l.Lock()
+	defer l.Unlock()
+	if max, ok := l.maxTTL[srcPort]; !ok || ttl < max {
+		l.maxTTL[srcPort] = ttl
+	}
+}
+
+// The highest ttl the source port is still probed at, 0 if it is not limited
+func (l *probeLimits) max(srcPort int) int {
+	l.RLock()
+	defer l.RUnlock()
+	return l.maxTTL[srcPort]
+}
+
+// Tell if the source port should still be probed at the ttl
+func (l *probeLimits) allowed(srcPort, ttl int) bool {
+	l.RLock()
+	defer l.RUnlock()
+	max, ok := l.maxTTL[srcPort]
+	return !ok || ttl <= max
+}
+
+// ForwardingLoop is a cycle of devices the probes of some flows go around instead of reaching the target
+type ForwardingLoop struct {
+	// the device at ttl Start answers again at ttl End
+	Start int
+	End   int
+	// the devices on the cycle, from the one at Start on
+	Devices []string
+	// the source ports caught in the loop
+	Flows []int
+}
+
+//
+// Find where the hop addresses loop back, if the responder seen at the given ttl goes around a cycle twice: it shows
+// up at three ttls the same distance apart, at least two hops. The same responder at adjacent ttls is usually a router
+// not decrementing the ttl, and a responder showing up just twice may well be on both branches of a load balancer
+// whose branches differ in length, rather than a loop. Returns the ttl the responder shows up at for the second time,
+// closing the first cycle it is on, or 0 if there is none
+//
+func loopEnd(addrs []string, ttl int) int {
+	addr := addrs[ttl-1]
+	if addr == "" {
+		return 0
+	}
+	for start := range addrs {
+		if addrs[start] != addr {
+			continue
+		}
+		for period := 2; start+2*period < len(addrs); period++ {
+			offset := ttl - 1 - start
+			if offset < 0 || offset > 2*period || offset%period != 0 {
+				continue
+			}
+			if addrs[start+period] == addr && addrs[start+2*period] == addr {
+				return start + period + 1
+			}
+		}
+	}
+	return 0
+}
+
+//
+// Find the forwarding loops in the hop addresses of every source port: the first responder that goes around a cycle
+// twice further down the path. The flows going around the same devices between the same ttls are reported together
+//
+func findLoops(addrs map[int] /* src port */ []string, hops map[int] /* src port */ []string) []*ForwardingLoop {
+	loops := make(map[string]*ForwardingLoop)
+
+	for srcPort, path := range addrs {
+		for i := range path {
+			if end := loopEnd(path, i+1); end > i+1 {
+				loop := &ForwardingLoop{Start: i + 1, End: end}
+				for ttl := loop.Start; ttl < loop.End; ttl++ {
+					loop.Devices = append(loop.Devices, hops[srcPort][ttl-1])
+				}
+				key := fmt.Sprintf("%d-%d %s", loop.Start, loop.End, strings.Join(loop.Devices, " "))
+				if loops[key] == nil {
+					loops[key] = loop
+				}
+				loops[key].Flows = append(loops[key].Flows, srcPort)
+				break
+			}
+		}
+	}
+
+	var result []*ForwardingLoop
+	for _, loop := range loops {
+		sort.Ints(loop.Flows)
+		result = append(result, loop)
+	}
+	sort.Sort(loopsByFlows(result))
+
+	return result
+}
+
+type loopsByFlows []*ForwardingLoop
+
+func (l loopsByFlows) Len() int      { return len(l) }
+func (l loopsByFlows) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l loopsByFlows) Less(i, j int) bool {
+	if len(l[i].Flows) != len(l[j].Flows) {
+		return len(l[i].Flows) > len(l[j].Flows)
+	}
+	return l[i].Flows[0] < l[j].Flows[0]
+}
+
+//
+// print the forwarding loops, with the devices going around and the flows caught in them
+//
+func printLoops(loops []*ForwardingLoop) {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"TTL", "devices", "flows", "src ports"})
+	for _, loop := range loops {
+		var ports []string
+		for _, flow := range loop.Flows {
+			ports = append(ports, fmt.Sprintf("%d", flow))
+		}
+		table.Append([]string{fmt.Sprintf("%d-%d", loop.Start, loop.End), strings.Join(loop.Devices, " -> ") + " -> " + loop.Devices[0],
+			fmt.Sprintf("%d", len(loop.Flows)), strings.Join(ports, ", ")})
+	}
+
+	fmt.Fprintf(os.Stdout, "Forwarding loops:\n")
+	table.Render()
+	fmt.Fprintf(os.Stdout, "\n")
+}
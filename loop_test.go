@@ -0,0 +1,68 @@
+/**
+ * Copyright (c) 2016-present, Facebook, Inc.
+ * All rights reserved.
+ *
+ * This source code is licensed under the BSD-style license found in the
+ * LICENSE file in the root directory of this source tree. An additional grant
+ * of patent rights can be found in the PATENTS file in the same directory.
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLoopEnd(t *testing.T) {
+	tests := []struct {
+		name  string
+		addrs []string
+		ttl   int
+		want  int
+	}{
+		{"period 2 at the first occurrence", []string{"a", "b", "c", "b", "c", "b", "c"}, 2, 4},
+		{"period 2 at the second occurrence", []string{"a", "b", "c", "b", "c", "b", "c"}, 4, 4},
+		{"period 2 at the third occurrence", []string{"a", "b", "c", "b", "c", "b", "c"}, 6, 4},
+		{"period 2 from the other device", []string{"a", "b", "c", "b", "c", "b", "c"}, 3, 5},
+		{"period 3", []string{"a", "b", "c", "d", "b", "c", "d", "b"}, 8, 5},
+		{"two occurrences only", []string{"a", "b", "c", "b", "c", "", ""}, 2, 0},
+		{"branches of different length", []string{"a", "b", "c", "d", "b", "e", ""}, 5, 0},
+		{"not decrementing the ttl", []string{"a", "b", "b", "b", "c"}, 3, 0},
+		{"no answer", []string{"a", "", "", "", "", ""}, 2, 0},
+		{"no loop", []string{"a", "b", "c", "d", "e"}, 5, 0},
+	}
+
+	for _, test := range tests {
+		if got := loopEnd(test.addrs, test.ttl); got != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFindLoops(t *testing.T) {
+	addrs := map[int][]string{
+		1: {"a", "b", "c", "b", "c", "b", "c"},
+		2: {"a", "b", "c", "b", "c", "b", "c"},
+		3: {"a", "d", "e", "f", "g", "", ""},
+		4: {"a", "d", "c", "b", "c", "b", "c"},
+	}
+	hops := map[int][]string{
+		1: {"A", "B", "C", "B", "C", "B", "C"},
+		2: {"A", "B", "C", "B", "C", "B", "C"},
+		3: {"A", "D", "E", "F", "G", "?", "?"},
+		4: {"A", "D", "C", "B", "C", "B", "C"},
+	}
+	want := []*ForwardingLoop{
+		{Start: 2, End: 4, Devices: []string{"B", "C"}, Flows: []int{1, 2}},
+		{Start: 3, End: 5, Devices: []string{"C", "B"}, Flows: []int{4}},
+	}
+
+	got := findLoops(addrs, hops)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %d loops, want %d", len(got), len(want))
+		for _, loop := range got {
+			t.Errorf("got %+v", *loop)
+		}
+	}
+}
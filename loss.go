@@ -0,0 +1,123 @@
+/**
+ * Copyright (c) 2016-present, Facebook, Inc.
+ * All rights reserved.
+ *
+ * This source code is licensed under the BSD-style license found in the
+ * LICENSE file in the root directory of this source tree. An additional grant
+ * of patent rights can be found in the PATENTS file in the same directory.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// LossInterval is the observed loss rate of a hop along with its confidence interval
+type LossInterval struct {
+	Loss  float64
+	Lower float64
+	Upper float64
+}
+
+// Format the interval for the report tables, in percent
+func (l LossInterval) String() string {
+	return fmt.Sprintf("%.0f [%.0f-%.0f]", 100*l.Loss, 100*l.Lower, 100*l.Upper)
+}
+
+//
+// Wilson score interval for the loss rate, given the probes sent and received, at the given significance level
+//
+func lossInterval(sent, rcvd int, alpha float64) LossInterval {
+	if sent <= 0 {
+		return LossInterval{Loss: 0, Lower: 0, Upper: 1}
+	}
+
+	n := float64(sent)
+	p := 1 - float64(rcvd)/n
+	z := normalQuantile(1 - alpha/2)
+
+	center := (p + z*z/(2*n)) / (1 + z*z/n)
+	margin := z / (1 + z*z/n) * math.Sqrt(p*(1-p)/n+z*z/(4*n*n))
+
+	return LossInterval{
+		Loss:  p,
+		Lower: math.Max(0, center-margin),
+		Upper: math.Min(1, center+margin),
+	}
+}
+
+//
+// Inverse of the standard normal CDF, found by bisection over math.Erf
+//
+func normalQuantile(p float64) float64 {
+	lo, hi := -10.0, 10.0
+	for i := 0; i < 100; i++ {
+		mid := (lo + hi) / 2
+		if 0.5*(1+math.Erf(mid/math.Sqrt2)) < p {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return (lo + hi) / 2
+}
+
+//
+// Detect a breaking point [i] with a change-point test: the hit rate of the segment after [i]
+// is compared against the segment up to and including [i] with a one-sided two-proportion z-test.
+// Unlike the strict monotonic rule, small-sample noise does not raise alarms, and a later hop
+// recovering slightly does not hide the loss. The most significant break is returned, provided it
+// passes the test at the given significance level (Bonferroni-corrected for the number of candidates)
+// Returns the index [i] of the last good hop, the size of the loss step after it and the z score
+//
+func isLossyBinomial(sent, rcvd []int, alpha float64) (int, float64, float64, bool) {
+	// just like the monotonic rule, do not alarm on single-hop segment
+	candidates := len(sent) - 2
+	if candidates < 1 {
+		return 0, 0, 0, false
+	}
+
+	zCritical := normalQuantile(1 - alpha/float64(candidates))
+
+	var bestZ, bestStep float64
+	bestIdx := -1
+
+	for i := 0; i < candidates; i++ {
+		var sentBefore, rcvdBefore, sentAfter, rcvdAfter int
+		for j := range sent {
+			if j <= i {
+				sentBefore += sent[j]
+				rcvdBefore += rcvd[j]
+			} else {
+				sentAfter += sent[j]
+				rcvdAfter += rcvd[j]
+			}
+		}
+		// the hop right before the break must have seen the probes
+		if sentBefore == 0 || sentAfter == 0 || sent[i] == 0 {
+			continue
+		}
+
+		pBefore := float64(rcvdBefore) / float64(sentBefore)
+		pAfter := float64(rcvdAfter) / float64(sentAfter)
+		pooled := float64(rcvdBefore+rcvdAfter) / float64(sentBefore+sentAfter)
+
+		stdErr := math.Sqrt(pooled * (1 - pooled) * (1/float64(sentBefore) + 1/float64(sentAfter)))
+		if stdErr == 0 {
+			continue
+		}
+
+		z := (pBefore - pAfter) / stdErr
+		if bestIdx < 0 || z > bestZ {
+			bestIdx, bestZ, bestStep = i, z, pBefore-pAfter
+		}
+	}
+
+	if bestIdx < 0 || bestZ < zCritical {
+		return 0, 0, bestZ, false
+	}
+
+	return bestIdx, bestStep, bestZ, true
+}
@@ -0,0 +1,86 @@
+/**
+ * Copyright (c) 2016-present, Facebook, Inc.
+ * All rights reserved.
+ *
+ * This source code is licensed under the BSD-style license found in the
+ * LICENSE file in the root directory of this source tree. An additional grant
+ * of patent rights can be found in the PATENTS file in the same directory.
+ */
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// the estimates below are checked to that many decimals
+const lossTolerance = 1e-4
+
+func TestNormalQuantile(t *testing.T) {
+	tests := []struct {
+		p    float64
+		want float64
+	}{
+		{0.5, 0},
+		{0.975, 1.959964},
+		{0.95, 1.644854},
+		{0.05, -1.644854},
+		{0.995, 2.575829},
+	}
+
+	for _, test := range tests {
+		if got := normalQuantile(test.p); math.Abs(got-test.want) > lossTolerance {
+			t.Errorf("normalQuantile(%v): got %v, want %v", test.p, got, test.want)
+		}
+	}
+}
+
+func TestLossInterval(t *testing.T) {
+	tests := []struct {
+		name       string
+		sent, rcvd int
+		want       LossInterval
+	}{
+		{"nothing sent", 0, 0, LossInterval{Loss: 0, Lower: 0, Upper: 1}},
+		{"10% loss", 100, 90, LossInterval{Loss: 0.1, Lower: 0.055229, Upper: 0.174366}},
+		{"no loss", 100, 100, LossInterval{Loss: 0, Lower: 0, Upper: 0.036994}},
+		{"all lost", 100, 0, LossInterval{Loss: 1, Lower: 0.963006, Upper: 1}},
+		{"few probes", 10, 5, LossInterval{Loss: 0.5, Lower: 0.236593, Upper: 0.763407}},
+	}
+
+	for _, test := range tests {
+		got := lossInterval(test.sent, test.rcvd, 0.05)
+		if math.Abs(got.Loss-test.want.Loss) > lossTolerance || math.Abs(got.Lower-test.want.Lower) > lossTolerance ||
+			math.Abs(got.Upper-test.want.Upper) > lossTolerance {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestIsLossyBinomial(t *testing.T) {
+	tests := []struct {
+		name       string
+		sent, rcvd []int
+		lossy      bool
+		// the last good hop and the loss step, if lossy
+		lastGood int
+		step     float64
+	}{
+		{"single segment", []int{100, 100}, []int{100, 50}, false, 0, 0},
+		{"no loss", []int{100, 100, 100, 100}, []int{100, 100, 100, 100}, false, 0, 0},
+		{"noise", []int{100, 100, 100, 100}, []int{100, 99, 100, 98}, false, 0, 0},
+		{"too few probes", []int{10, 10, 10}, []int{10, 9, 8}, false, 0, 0},
+		{"break in the middle", []int{100, 100, 100, 100}, []int{100, 100, 50, 50}, true, 1, 0.5},
+		{"break after the first hop", []int{100, 100, 100, 100}, []int{100, 50, 50, 50}, true, 0, 0.5},
+		{"recovering hop", []int{100, 100, 100, 100, 100}, []int{100, 100, 50, 55, 50}, true, 1, 0.483333},
+		{"hop that never saw the probes", []int{100, 0, 100, 100}, []int{100, 0, 50, 50}, true, 0, 0.5},
+	}
+
+	for _, test := range tests {
+		lastGood, step, _, lossy := isLossyBinomial(test.sent, test.rcvd, 0.05)
+		if lossy != test.lossy || (lossy && (lastGood != test.lastGood || math.Abs(step-test.step) > lossTolerance)) {
+			t.Errorf("%s: got %v at %d step %v, want %v at %d step %v", test.name, lossy, lastGood, step, test.lossy, test.lastGood, test.step)
+		}
+	}
+}
@@ -10,12 +10,14 @@
 package main
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"math/rand"
 	"net"
 	"os"
+	"strings"
 	"syscall"
 	"time"
 
@@ -40,6 +42,19 @@ var showAll = flag.Bool("showAll", false, "Show all paths, regardless of loss de
 var srcAddr = flag.String("srcAddr", "", "The source address for pings, default to auto-discover")
 var jsonOutput = flag.Bool("jsonOutput", false, "Output raw JSON data")
 var baseSrcPort = flag.Int("baseSrcPort", 32768, "The base source port to start probing from")
+var probeType = flag.String("probeType", "tcp", "The probe type (tcp/udp/icmp) to use")
+var latencyThreshold = flag.Float64("latencyThreshold", 5, "The extra RTT in milliseconds, over the paths sharing a hop, to flag a path as a latency anomaly")
+var probeTimeout = flag.Int("probeTimeout", 2000, "The time to wait for a probe response, in milliseconds")
+var detectorName = flag.String("detector", "monotonic", "The loss detector (monotonic/binomial) to use")
+var significance = flag.Float64("significance", 0.05, "The significance level of the binomial loss test and the loss confidence intervals")
+var calibrateTarget = flag.Bool("calibrate", false, "Measure the response ceiling of the target with a burst of probes before tracing, and scale its hit rates accordingly")
+var mda = flag.Bool("mda", false, "Explore the paths adaptively with the Multipath Detection Algorithm, and measure loss over the flows discovered only")
+var mdaConfidence = flag.Float64("mdaConfidence", 0.95, "The confidence of MDA in having discovered all next hops of every node")
+var classifyLB = flag.Bool("classifyLB", false, "Repeat the same flows at every ttl before tracing, to tell per-packet, per-flow and per-destination load balancers apart")
+var lbDestinations = flag.Int("lbDestinations", 4, "The number of addresses next to the target probed to find per-destination load balancers, 0 to skip")
+var numeric = flag.Bool("numeric", false, "Show the responders by address only, without looking up their DNS names")
+var showGraph = flag.Bool("showGraph", false, "Show the load-balanced topology merged from the paths of all source ports")
+var unprivileged = flag.Bool("unprivileged", false, "Trace with ordinary UDP sockets and IP_RECVERR, no raw sockets or root needed (udp probes only)")
 
 //
 // Discover the source address for pinging
@@ -74,10 +89,20 @@ func resolveName(dest string, af string) (*net.IP, error) {
 	return &addr.IP, err
 }
 
+// Label a responder by its address, along with its DNS name if known and wanted
+func hopLabel(addr, name string) string {
+	if name == "" || *numeric {
+		return addr
+	}
+	return fmt.Sprintf("%s (%s)", name, addr)
+}
+
 // Probe is emitted by sender
 type Probe struct {
 	srcPort int
 	ttl     int
+	// tells apart the probes sent with the same source port and ttl
+	tag uint32
 }
 
 // ICMPResponse is emitted by ICMPReceiver
@@ -85,21 +110,56 @@ type ICMPResponse struct {
 	Probe
 	fromAddr *net.IP
 	fromName string
-	rtt      uint32
+	// the type and code of the ICMP error, and the extensions following the quoted probe
+	icmpError  *ICMPError
+	extensions *icmpExtensions
+	// monotonic time of reception, rtt is found by matching against the probe table
+	received int64
+	rtt      time.Duration
 }
 
 // TCPResponse is emitted by TCPReceiver
 type TCPResponse struct {
 	Probe
-	rtt uint32
+	received int64
+	rtt      time.Duration
+}
+
+// UDPResponse is emitted by ICMPReceiver when the target reports its port unreachable
+type UDPResponse struct {
+	Probe
+	received int64
+	rtt      time.Duration
+}
+
+// EchoResponse is emitted by ICMPReceiver when the target answers our echo request
+type EchoResponse struct {
+	Probe
+	received int64
+	rtt      time.Duration
+}
+
+// Return the IP protocol number used by the given probe type in the given address family
+func probeProtocol(af, probeType string) (int, error) {
+	switch {
+	case probeType == "tcp":
+		return syscall.IPPROTO_TCP, nil
+	case probeType == "udp":
+		return syscall.IPPROTO_UDP, nil
+	case probeType == "icmp" && af == "ip4":
+		return syscall.IPPROTO_ICMP, nil
+	case probeType == "icmp" && af == "ip6":
+		return syscall.IPPROTO_ICMPV6, nil
+	}
+	return 0, fmt.Errorf("Unknown probe type %s", probeType)
 }
 
 // TCPReceiver Feeds on TCP RST messages we receive from the end host; we use lots of parameters to check if the incoming packet
-// is actually a response to our probe. We create TCPResponse structs and emit them on the output channel
-func TCPReceiver(done <-chan struct{}, af string, targetAddr string, probePortStart, probePortEnd, targetPort, maxTTL int) (chan interface{}, error) {
+// is actually a response to our probe. We create TCPResponse structs and emit them on the output channel.
+// Malformed packets are counted in the drop stats
+func TCPReceiver(done <-chan struct{}, af string, drops *dropStats, targetAddr string, probePortStart, probePortEnd, targetPort, maxTTL int) (chan interface{}, error) {
 	var recvSocket int
 	var err error
-	var ipHdrSize int
 
 	glog.V(2).Infoln("TCPReceiver starting...")
 
@@ -107,12 +167,8 @@ func TCPReceiver(done <-chan struct{}, af string, targetAddr string, probePortSt
 	switch {
 	case af == "ip4":
 		recvSocket, err = syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_TCP)
-		// IPv4 header is always included with the ipv4 raw socket receive
-		ipHdrSize = 20
 	case af == "ip6":
 		recvSocket, err = syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW, syscall.IPPROTO_TCP)
-		// no IPv6 header present on TCP packets received on the raw socket
-		ipHdrSize = 0
 	default:
 		return nil, fmt.Errorf("Unknown address family supplied")
 	}
@@ -128,7 +184,7 @@ func TCPReceiver(done <-chan struct{}, af string, targetAddr string, probePortSt
 	recv := make(chan TCPResponse)
 	go func() {
 		const tcpHdrSize int = 20
-		packet := make([]byte, ipHdrSize+tcpHdrSize)
+		packet := make([]byte, ipv4MaxHdrSize+tcpHdrSize)
 
 		for {
 			n, from, err := syscall.Recvfrom(recvSocket, packet, 0)
@@ -137,16 +193,30 @@ func TCPReceiver(done <-chan struct{}, af string, targetAddr string, probePortSt
 				break
 			}
 
+			// IPv4 header is always included with the ipv4 raw socket receive, options included;
+			// no IPv6 header present on TCP packets received on the raw socket
+			ipHdrSize := 0
+			if af == "ip4" {
+				if ipHdrSize, err = ipv4HeaderLen(packet[:n]); err != nil {
+					drops.drop(err)
+					continue
+				}
+			}
+
 			// IP + TCP header size
 			if n < ipHdrSize+tcpHdrSize {
+				drops.drop(errTransportTooShort)
 				continue
 			}
 
-			// is that from the target port we expect?
+			// is that from the target port we expect, to one of our source ports?
 			tcpHdr := parseTCPHeader(packet[ipHdrSize:n])
 			if int(tcpHdr.Source) != targetPort {
 				continue
 			}
+			if int(tcpHdr.Destination) < probePortStart || int(tcpHdr.Destination) >= probePortEnd {
+				continue
+			}
 
 			// is that TCP RST TCP ACK?
 			if tcpHdr.Flags&RST != RST && tcpHdr.Flags&ACK != ACK {
@@ -167,25 +237,13 @@ func TCPReceiver(done <-chan struct{}, af string, targetAddr string, probePortSt
 				continue
 			}
 
-			// we extract the original TTL and timestamp from the ack number
-			ackNum := tcpHdr.AckNum - 1
-			ttl := int(ackNum >> 24)
-
-			if ttl > maxTTL || ttl < 1 {
+			// we extract the original TTL and tag from the ack number, and make sure this run has sent it
+			probe, own := parseProbeSeqNum(int(tcpHdr.Destination), tcpHdr.AckNum-1)
+			if !own || probe.ttl > maxTTL || probe.ttl < 1 {
 				continue
 			}
 
-			// recover the time-stamp from the ack #
-			ts := ackNum & 0x00ffffff
-			now := uint32(time.Now().UnixNano()/(1000*1000)) & 0x00ffffff
-
-			// received timestamp is higher than local time; it is possible
-			// that ts == now, since our clock resolution is coarse
-			if ts > now {
-				continue
-			}
-
-			recv <- TCPResponse{Probe: Probe{srcPort: int(tcpHdr.Destination), ttl: ttl}, rtt: now - ts}
+			recv <- TCPResponse{Probe: probe, received: monotime()}
 		}
 	}()
 
@@ -207,35 +265,32 @@ func TCPReceiver(done <-chan struct{}, af string, targetAddr string, probePortSt
 }
 
 // ICMPReceiver runs on its own collecting ICMP responses until its explicitly told to stop
-func ICMPReceiver(done <-chan struct{}, af string) (chan interface{}, error) {
+// Every ICMP error quoting one of our probes is decoded, the ones merely informing us are logged and dropped
+// Responses that do not map onto the probed source port range and ttls are dropped, and so are the ones quoting
+// a packet we could not have sent: of another protocol, from another source or to a destination we do not probe.
+// Malformed and foreign packets are counted in the drop stats
+func ICMPReceiver(done <-chan struct{}, af string, drops *dropStats, proto int, srcAddr *net.IP, targetAddr string, dstAddrs []string, probePortStart, probePortEnd, maxTTL int) (chan interface{}, error) {
 	var recvSocket int
 	var err error
-	var outerIPHdrSize int
-	var innerIPHdrSize int
-	var icmpMsgType byte
+	var icmpUnreachType, icmpPortUnreachCode byte
+	var icmpEchoReplyType byte
+	var icmpProto int
 
-	const (
-		icmpHdrSize int = 8
-		tcpHdrSize  int = 8
-	)
+	const icmpHdrSize int = 8
 
 	switch {
 	case af == "ip4":
 		recvSocket, err = syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_ICMP)
-		// IPv4 raw socket always prepend the transport IPv4 header
-		outerIPHdrSize = 20
-		// the size of the original IPv4 header that was on the TCP packet sent out
-		innerIPHdrSize = 20
-		// hardcoded: time to live exceeded
-		icmpMsgType = 11
+		// destination unreachable, port unreachable
+		icmpUnreachType, icmpPortUnreachCode = 3, 3
+		icmpEchoReplyType = icmpv4EchoReply
+		icmpProto = syscall.IPPROTO_ICMP
 	case af == "ip6":
 		recvSocket, err = syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW, syscall.IPPROTO_ICMPV6)
-		// IPv6 raw socket does not prepend the original transport IPv6 header
-		outerIPHdrSize = 0
-		// this is the size of IPv6 header of the original TCP packet we used in the probes
-		innerIPHdrSize = 40
-		// time to live exceeded
-		icmpMsgType = 3
+		// destination unreachable, port unreachable
+		icmpUnreachType, icmpPortUnreachCode = 1, 4
+		icmpEchoReplyType = icmpv6EchoReply
+		icmpProto = syscall.IPPROTO_ICMPV6
 	}
 
 	if err != nil {
@@ -246,24 +301,47 @@ func ICMPReceiver(done <-chan struct{}, af string) (chan interface{}, error) {
 
 	recv := make(chan interface{})
 
+	// could that be one of our probes? it must carry the instance id of this run
+	valid := func(probe Probe) bool {
+		return probe.srcPort >= probePortStart && probe.srcPort < probePortEnd && probe.ttl >= 1 && probe.ttl <= maxTTL && ownTag(probe.tag)
+	}
+
+	drop := func(reason error, packet []byte) {
+		glog.V(3).Infof("Dropping ICMP message, %s: %x\n", reason, packet)
+		drops.drop(reason)
+	}
+
+	respond := func(probe Probe, icmpErr *ICMPError, extensions *icmpExtensions, fromAddr net.IP, received int64) {
+		// redirects and source quenches do not stop the probe, it still gets answered further down the path
+		if icmpErr.Outcome == outcomeNotice {
+			glog.V(2).Infof("Received %s from %s for source port %d ttl %d\n", icmpErr, fromAddr, probe.srcPort, probe.ttl)
+			return
+		}
+		recv <- ICMPResponse{Probe: probe, fromAddr: &fromAddr, icmpError: icmpErr, extensions: extensions, received: received}
+	}
+
 	go func() {
-		// TODO: remove hardcode; 20 bytes for IP header, 8 bytes for ICMP header, 8 bytes for TCP header
-		packet := make([]byte, outerIPHdrSize+icmpHdrSize+innerIPHdrSize+tcpHdrSize)
+		packet := make([]byte, recvBufferSize)
 		for {
 			n, from, err := syscall.Recvfrom(recvSocket, packet, 0)
 			if err != nil {
 				break
 			}
-			// extract the 8 bytes of the original TCP header
-			if n < outerIPHdrSize+icmpHdrSize+innerIPHdrSize+tcpHdrSize {
-				continue
+			received := monotime()
+
+			// IPv4 raw sockets prepend the IP header, options included; IPv6 raw sockets do not
+			outerIPHdrSize := 0
+			if af == "ip4" {
+				if outerIPHdrSize, err = ipv4HeaderLen(packet[:n]); err != nil {
+					drop(err, packet[:n])
+					continue
+				}
 			}
-			// not ttl exceeded
-			if packet[outerIPHdrSize] != icmpMsgType || packet[outerIPHdrSize+1] != 0 {
+			if n < outerIPHdrSize+icmpHdrSize {
+				drop(errTruncated, packet[:n])
 				continue
 			}
-			glog.V(4).Infof("Received ICMP response message %d: %x\n", len(packet), packet)
-			tcpHdr := parseTCPHeader(packet[outerIPHdrSize+icmpHdrSize+innerIPHdrSize : n])
+			icmpType, icmpCode := packet[outerIPHdrSize], packet[outerIPHdrSize+1]
 
 			var fromAddr net.IP
 
@@ -274,14 +352,81 @@ func ICMPReceiver(done <-chan struct{}, af string) (chan interface{}, error) {
 				fromAddr = net.IP(from.(*syscall.SockaddrInet6).Addr[:])
 			}
 
-			// extract ttl bits from the ISN
-			ttl := int(tcpHdr.SeqNum) >> 24
+			// the target has answered our echo request
+			if icmpType == icmpEchoReplyType && icmpCode == 0 {
+				if n != outerIPHdrSize+icmpHdrSize+icmpEchoPayloadSize {
+					continue
+				}
+				// is that from our target?
+				if fromAddr.String() != targetAddr {
+					continue
+				}
+				echo := parseICMPEchoHeader(packet[outerIPHdrSize:n])
+				// the flow id is echoed back in the payload
+				flow := int(binary.BigEndian.Uint16(packet[outerIPHdrSize+icmpHdrSize:]))
+				if probe, own := echo.probe(flow); own && valid(probe) {
+					recv <- EchoResponse{Probe: probe, received: received}
+				}
+				continue
+			}
+
+			// not an error, or not one quoting a packet
+			icmpErr := newICMPError(af, int(icmpType), int(icmpCode))
+			if icmpErr == nil {
+				continue
+			}
+			glog.V(4).Infof("Received ICMP response message %d: %x\n", n, packet[:n])
+
+			// the original IP header of our probe and the 8 bytes of its transport header follow the ICMP header
+			quote := packet[outerIPHdrSize+icmpHdrSize : n]
+			inner, err := parseInnerHeader(af, quote)
+			if err == nil {
+				err = inner.validate(proto, srcAddr, dstAddrs)
+			}
+			if err != nil {
+				drop(err, packet[:n])
+				continue
+			}
+			transport := quote[inner.size:]
+			// the MPLS label stack and such may follow the quoted probe
+			extensions := parseICMPExtensions(af, packet[outerIPHdrSize:outerIPHdrSize+icmpHdrSize], quote)
+
+			switch {
+			case inner.proto == syscall.IPPROTO_TCP:
+				tcpHdr := parseTCPHeader(transport)
+
+				// extract the ttl, the tag and the check byte from the ISN
+				probe, own := parseProbeSeqNum(int(tcpHdr.Source), tcpHdr.SeqNum)
+				if !own || !valid(probe) {
+					continue
+				}
+				respond(probe, icmpErr, extensions, fromAddr, received)
+			case inner.proto == syscall.IPPROTO_UDP:
+				udpHdr := parseUDPHeader(transport)
+
+				// the ttl is in the length, the tag is hidden in the checksum
+				ttl := udpHdr.probeTTL()
+				probe := Probe{srcPort: int(udpHdr.Source), ttl: ttl, tag: udpProbeTag(int(udpHdr.Source), ttl, udpHdr.Checksum)}
+				if !valid(probe) {
+					continue
+				}
+
+				// port unreachable from the destination of the probe means the probe made it there
+				if icmpType == icmpUnreachType && icmpCode == icmpPortUnreachCode && fromAddr.Equal(inner.dst) {
+					recv <- UDPResponse{Probe: probe, received: received}
+				} else {
+					respond(probe, icmpErr, extensions, fromAddr, received)
+				}
+			case inner.proto == icmpProto:
+				echo := parseICMPEchoHeader(transport)
 
-			// extract the timestamp from the ISN
-			ts := tcpHdr.SeqNum & 0x00ffffff
-			// scale the current time
-			now := uint32(time.Now().UnixNano()/(1000*1000)) & 0x00ffffff
-			recv <- ICMPResponse{Probe: Probe{srcPort: int(tcpHdr.Source), ttl: ttl}, fromAddr: &fromAddr, rtt: now - ts}
+				// the checksum is the flow, the sequence is the ttl and the check byte, the identifier is the tag
+				probe, own := echo.probe(int(echo.Checksum))
+				if !own || !valid(probe) {
+					continue
+				}
+				respond(probe, icmpErr, extensions, fromAddr, received)
+			}
 		}
 	}()
 
@@ -315,10 +460,9 @@ func Resolver(input chan interface{}) (chan interface{}, error) {
 			switch val.(type) {
 			case ICMPResponse:
 				resp := val.(ICMPResponse)
+				// the name is left empty if the address does not resolve
 				names, err := net.LookupAddr(resp.fromAddr.String())
-				if err != nil {
-					resp.fromName = "?"
-				} else {
+				if err == nil && len(names) > 0 {
 					resp.fromName = names[0]
 				}
 				out <- resp
@@ -330,10 +474,10 @@ func Resolver(input chan interface{}) (chan interface{}, error) {
 	return out, nil
 }
 
-// Sender generates TCP SYN packet probes with given TTL at given packet per second rate
-// The packet descriptions are published to the output channel as Probe messages
+// Sender generates TCP SYN, UDP or ICMP echo packet probes with given TTL at given packet per second rate
+// The packet descriptions are published to the output channel as Probe messages, and recorded in the probe table
 // As a side effect, the packets are injected into raw socket
-func Sender(done <-chan struct{}, srcAddr *net.IP, af, dest string, dstPort, baseSrcPort, maxSrcPorts, maxIters, ttl, pps, tos int) (chan interface{}, error) {
+func Sender(done <-chan struct{}, table *ProbeTable, limits *probeLimits, srcAddr *net.IP, af, dest, probeType string, dstPort int, srcPorts []int, maxIters, ttl, pps, tos int) (chan interface{}, error) {
 	var err error
 
 	out := make(chan interface{})
@@ -345,14 +489,19 @@ func Sender(done <-chan struct{}, srcAddr *net.IP, af, dest string, dstPort, bas
 		return nil, err
 	}
 
+	proto, err := probeProtocol(af, probeType)
+	if err != nil {
+		return nil, err
+	}
+
 	var sendSocket int
 
 	// create the socket
 	switch {
 	case af == "ip4":
-		sendSocket, err = syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_TCP)
+		sendSocket, err = syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, proto)
 	case af == "ip6":
-		sendSocket, err = syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW, syscall.IPPROTO_TCP)
+		sendSocket, err = syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW, proto)
 	}
 
 	if err != nil {
@@ -402,54 +551,93 @@ func Sender(done <-chan struct{}, srcAddr *net.IP, af, dest string, dstPort, bas
 	// spawn a new goroutine and return the channel to be used for reading
 	go func() {
 		defer syscall.Close(sendSocket)
-		defer close(out)
-
-		delay := time.Duration(1000/pps) * time.Millisecond
 
-		for i := 0; i < maxSrcPorts*maxIters; i++ {
-			srcPort := baseSrcPort + i%maxSrcPorts
-			probe := Probe{srcPort: srcPort, ttl: ttl}
-			now := uint32(time.Now().UnixNano()/(1000*1000)) & 0x00ffffff
-			seqNum := ((uint32(ttl) & 0xff) << 24) | (now & 0x00ffffff)
-			packet := makeTCPHeader(af, srcAddr, dstAddr, srcPort, dstPort, seqNum)
+		sendLoop(done, out, table, limits, srcPorts, maxIters, ttl, pps, func(probe Probe) error {
+			var packet []byte
+			switch {
+			case proto == syscall.IPPROTO_TCP:
+				packet = makeTCPHeader(af, srcAddr, dstAddr, probe.srcPort, dstPort, probeSeqNum(probe))
+			case proto == syscall.IPPROTO_UDP:
+				packet = makeUDPPacket(af, srcAddr, dstAddr, probe.srcPort, dstPort, ttl, udpProbeChecksum(probe))
+			case proto == syscall.IPPROTO_ICMP || proto == syscall.IPPROTO_ICMPV6:
+				// the source port becomes the flow id
+				packet = makeICMPEchoPacket(af, srcAddr, dstAddr, probe)
+			}
 
 			switch {
 			case af == "ip4":
 				var sockaddr [4]byte
 				copy(sockaddr[:], dstAddr.To4())
-				err = syscall.Sendto(sendSocket, packet, 0, &syscall.SockaddrInet4{Port: 0, Addr: sockaddr})
+				return syscall.Sendto(sendSocket, packet, 0, &syscall.SockaddrInet4{Port: 0, Addr: sockaddr})
 			case af == "ip6":
 				var sockaddr [16]byte
 				copy(sockaddr[:], dstAddr.To16())
 				// with IPv6 the dst port must be zero, otherwise the syscall fails
-				err = syscall.Sendto(sendSocket, packet, 0, &syscall.SockaddrInet6{Port: 0, Addr: sockaddr})
+				return syscall.Sendto(sendSocket, packet, 0, &syscall.SockaddrInet6{Port: 0, Addr: sockaddr})
 			}
+			return nil
+		})
+	}()
 
-			if err != nil {
-				glog.Errorf("Error sending packet %s\n", err)
-				break
-			}
+	return out, nil
+}
 
-			// grab time before blocking on send channel
-			start := time.Now()
-			select {
-			case out <- probe:
-				end := time.Now()
-				jitter := time.Duration(((rand.Float64()-0.5)/20)*1000/float64(pps)) * time.Millisecond
-				if end.Sub(start) < delay+jitter {
-					time.Sleep(delay + jitter - (end.Sub(start)))
-				}
-			case <-done:
-				glog.V(2).Infof("Sender for ttl %d exiting prematurely\n", ttl)
-				return
-			}
-		}
-		glog.V(2).Infoln("Sender done")
-	}()
+// UnprivilegedSender generates UDP probes with given TTL at given packet per second rate
+// over the connected sockets of the pool, so no raw socket (and no root) is needed.
+// Just like Sender, the packet descriptions are published to the output channel as Probe messages
+func UnprivilegedSender(done <-chan struct{}, table *ProbeTable, limits *probeLimits, pool *udpSocketPool, srcPorts []int, maxIters, ttl, pps int) (chan interface{}, error) {
+	out := make(chan interface{})
+
+	glog.V(2).Infof("Unprivileged sender for ttl %d starting\n", ttl)
+
+	go sendLoop(done, out, table, limits, srcPorts, maxIters, ttl, pps, func(probe Probe) error {
+		return pool.send(probe.srcPort, ttl, makeUDPPayload(probe))
+	})
 
 	return out, nil
 }
 
+//
+// Loop over the source ports for maxIters iterations, calling send() for every probe
+// at the given packet per second rate. Every probe is recorded in the table right before
+// it is sent, and published to the out channel, which is closed once we are done or told to stop.
+// The source ports no longer worth probing at this ttl according to the limits are skipped
+//
+func sendLoop(done <-chan struct{}, out chan interface{}, table *ProbeTable, limits *probeLimits, srcPorts []int, maxIters, ttl, pps int, send func(probe Probe) error) {
+	defer close(out)
+
+	delay := time.Duration(1000/pps) * time.Millisecond
+
+	for i := 0; i < len(srcPorts)*maxIters; i++ {
+		srcPort := srcPorts[i%len(srcPorts)]
+		probe := Probe{srcPort: srcPort, ttl: ttl, tag: probeTag(i / len(srcPorts))}
+		if !limits.allowed(srcPort, ttl) {
+			continue
+		}
+
+		table.add(probe)
+		if err := send(probe); err != nil {
+			glog.Errorf("Error sending packet %s\n", err)
+			break
+		}
+
+		// grab time before blocking on send channel
+		start := time.Now()
+		select {
+		case out <- probe:
+			end := time.Now()
+			jitter := time.Duration(((rand.Float64()-0.5)/20)*1000/float64(pps)) * time.Millisecond
+			if end.Sub(start) < delay+jitter {
+				time.Sleep(delay + jitter - (end.Sub(start)))
+			}
+		case <-done:
+			glog.V(2).Infof("Sender for ttl %d exiting prematurely\n", ttl)
+			return
+		}
+	}
+	glog.V(2).Infoln("Sender done")
+}
+
 //
 // Normalize rcvd by send count to get the hit rate
 //
@@ -470,40 +658,94 @@ func normalizeRcvd(sent, rcvd []int) ([]float64, error) {
 // Detect a pattern where all samples after
 // a sample [i] have lower hit rate than [i]
 // this normally indicates a breaking point after [i]
+// Returns the index [i] of the last good sample
+// and the size of the loss step after it
 //
-func isLossy(hitRates []float64) bool {
-	var found bool
-	var segLen int
-	for i := 0; i < len(hitRates)-1 && !found; i++ {
-		found = true
-		segLen = len(hitRates) - i
+func isLossy(hitRates []float64) (int, float64, bool) {
+	for i := 0; i < len(hitRates)-1; i++ {
+		found := true
+		// the best hit rate after [i]
+		var best float64
 		for j := i + 1; j < len(hitRates); j++ {
 			if hitRates[j] >= hitRates[i] {
 				found = false
 				break
 			}
+			if hitRates[j] > best {
+				best = hitRates[j]
+			}
+		}
+		if found {
+			// do not alarm on single-hop segment
+			if len(hitRates)-i > 2 {
+				return i, hitRates[i] - best, true
+			}
+			return 0, 0, false
 		}
 	}
-	// do not alarm on single-hop segment
-	if segLen > 2 {
-		return found
-	}
-	return false
+	return 0, 0, false
+}
+
+// LossBreak tells where the loss starts on a path: between the last good hop and the first bad hop
+type LossBreak struct {
+	LastGoodTTL int
+	LastGoodHop string
+	FirstBadTTL int
+	FirstBadHop string
+	// the drop of the hit rate after the last good hop
+	Step float64
+}
+
+// Describe the break point for the report tables
+func (b *LossBreak) String() string {
+	return fmt.Sprintf("loss starts between %s (ttl %d) and %s (ttl %d), -%.0f%%", b.LastGoodHop, b.LastGoodTTL, b.FirstBadHop, b.FirstBadTTL, 100*b.Step)
+}
+
+// analysis is everything found about the paths traced, as reported in the tables and in the JSON report
+type analysis struct {
+	// the probe counts, hops, RTT statistics and loss rates of the paths reported, per source port
+	sent, rcvd map[int] /* src port */ []int
+	hops       map[int] /* src port */ []string
+	rtts       map[int] /* src port */ []RTTStats
+	losses     map[int] /* src port */ []LossInterval
+	// the hops getting slower than their siblings, the suspect links of the lossy paths and the verdicts of all paths
+	anomalies map[int] /* src port */ []LatencyAnomaly
+	breaks    map[int] /* src port */ *LossBreak
+	verdicts  map[int] /* src port */ Verdict
+	// the hops left out of the loss detection, and the response ceiling of the target
+	silentHops  []SilentHop
+	rateLimits  map[string] /* responder */ *RateLimit
+	calibration *Calibration
+	// the topology, the loss of its links and the hops ranked by blame
+	graph    *Graph
+	linkLoss []LinkLoss
+	blame    []*HopBlame
+	// the hop changes, the load balancers and the forwarding loops
+	flaps     []*FlapHistory
+	balancers []*Balancer
+	loops     []*ForwardingLoop
+	// the ICMP errors and extensions of the latest responses per hop, and where the paths ended
+	icmpErrors map[int] /* src port */ []*ICMPError
+	extensions map[int] /* src port */ []*icmpExtensions
+	outcomes   map[int] /* src port */ *PathOutcome
+	ends       []*PathEnd
+	// no path goes further than that
+	maxTTL int
 }
 
 //
 // print the paths reported as having losses
 //
-func printLossyPaths(sent, rcvd map[int] /* src port */ []int, hops map[int] /* src port */ []string, maxColumns, maxTTL int) {
+func printLossyPaths(a *analysis, maxColumns int) {
 	var allPorts []int
 
-	for srcPort := range hops {
+	for srcPort := range a.hops {
 		allPorts = append(allPorts, srcPort)
 	}
 
 	// split in multiple tables to fit the columns on the screen
-	for i := 0; i < len(allPorts)/maxColumns; i++ {
-		data := make([][]string, maxTTL)
+	for i := 0; i*maxColumns < len(allPorts); i++ {
+		data := make([][]string, a.maxTTL)
 		table := tablewriter.NewWriter(os.Stdout)
 		header := []string{"TTL"}
 
@@ -513,17 +755,30 @@ func printLossyPaths(sent, rcvd map[int] /* src port */ []int, hops map[int] /*
 		}
 
 		for _, srcPort := range allPorts[i*maxColumns : maxOffset] {
-			header = append(header, fmt.Sprintf("port: %d", srcPort), fmt.Sprintf("sent/rcvd"))
+			header = append(header, fmt.Sprintf("port: %d", srcPort), fmt.Sprintf("sent/rcvd"), fmt.Sprintf("loss %%"), fmt.Sprintf("rtt ms"))
 		}
 
 		table.SetHeader(header)
 
-		for ttl := 0; ttl < maxTTL-1; ttl++ {
-			data[ttl] = make([]string, 2*(maxOffset-i*maxColumns)+1)
+		for ttl := 0; ttl < a.maxTTL-1; ttl++ {
+			data[ttl] = make([]string, 4*(maxOffset-i*maxColumns)+1)
 			data[ttl][0] = fmt.Sprintf("%d", ttl+1)
 			for j, srcPort := range allPorts[i*maxColumns : maxOffset] {
-				data[ttl][2*j+1] = hops[srcPort][ttl]
-				data[ttl][2*j+2] = fmt.Sprintf("%02d/%02d", sent[srcPort][ttl], rcvd[srcPort][ttl])
+				// the path was cut short by a loop or by a hop stopping the probes
+				if ttl >= len(a.hops[srcPort]) {
+					continue
+				}
+				data[ttl][4*j+1] = a.hops[srcPort][ttl]
+				// the interface the probes came in on and their label stack, if the hop told us
+				if ttl < len(a.extensions[srcPort]) && !a.extensions[srcPort][ttl].empty() {
+					data[ttl][4*j+1] += " " + a.extensions[srcPort][ttl].annotation()
+				}
+				data[ttl][4*j+2] = fmt.Sprintf("%02d/%02d", a.sent[srcPort][ttl], a.rcvd[srcPort][ttl])
+				data[ttl][4*j+3] = a.losses[srcPort][ttl].String()
+				if a.hops[srcPort][ttl] == nonResponding {
+					data[ttl][4*j+3] = "-"
+				}
+				data[ttl][4*j+4] = a.rtts[srcPort][ttl].String()
 			}
 		}
 
@@ -531,6 +786,36 @@ func printLossyPaths(sent, rcvd map[int] /* src port */ []int, hops map[int] /*
 			table.Append(v)
 		}
 
+		// name the suspect link under every lossy path
+		var suspects []string
+		found := false
+		for _, srcPort := range allPorts[i*maxColumns : maxOffset] {
+			if b := a.breaks[srcPort]; b != nil {
+				suspects = append(suspects, fmt.Sprintf("%s -> %s", b.LastGoodHop, b.FirstBadHop), fmt.Sprintf("-%.0f%%", 100*b.Step), "", "")
+				found = true
+			} else {
+				suspects = append(suspects, "", "", "", "")
+			}
+		}
+		if found {
+			table.Append(append([]string{"loss"}, suspects...))
+		}
+
+		// tell how the paths stopped short of the target ended
+		var ends []string
+		found = false
+		for _, srcPort := range allPorts[i*maxColumns : maxOffset] {
+			if o := a.outcomes[srcPort]; o != nil && o.Error != nil {
+				ends = append(ends, o.Outcome, fmt.Sprintf("%d/%d", o.Error.Type, o.Error.Code), "", "")
+				found = true
+			} else {
+				ends = append(ends, "", "", "", "")
+			}
+		}
+		if found {
+			table.Append(append([]string{"outcome"}, ends...))
+		}
+
 		table.Render()
 		fmt.Fprintf(os.Stdout, "\n")
 	}
@@ -544,12 +829,59 @@ type Report struct {
 	Sent map[string][]int
 	// Probe count received per source port/hop name
 	Rcvd map[string][]int
+	// RTT statistics per source port/hop name
+	RTT map[string][]RTTStats
+	// Loss rate and its confidence interval per source port/hop name
+	Loss map[string][]LossInterval
+	// Hops where the RTT of the source port path jumps over its siblings
+	Anomalies map[string][]LatencyAnomaly
+	// The suspected failing link per lossy source port
+	Breaks map[string]*LossBreak
+	// The loss detector used and the explanation of its verdict per source port
+	Detector     string
+	Explanations map[string]string
+	// The ttls of the hops that never answered per source port, and the summary per ttl across all paths
+	NonResponding map[string][]int
+	SilentHops    []SilentHop
+	// The responders found to rate limit their ICMP responses, left out of the loss detection
+	RateLimits map[string]*RateLimit
+	// The response ceiling of the target, if calibrated
+	Calibration *Calibration
+	// The load-balanced topology merged from all paths, and the loss rates of its links
+	Graph    *Graph
+	LinkLoss []LinkLoss
+	// The hops crossed by the lossy paths, ranked by how likely they are to cause the loss
+	Blame []*HopBlame
+	// The hop changes per source port and ttl, and the behaviour behind them
+	Flaps []*FlapHistory
+	// The branching points and the way they balance the traffic, if classified
+	Balancers []*Balancer
+	// The forwarding loops, with the devices going around and the flows caught in them
+	Loops []*ForwardingLoop
+	// The ICMP error type and code per source port/hop, and how the probes of every source port ended
+	ICMP     map[string][]*ICMPError
+	Outcomes map[string]*PathOutcome
+	// The MPLS label stack and the interfaces per source port/hop, as the routers tell them in their ICMP extensions
+	MPLS       map[string][][]MPLSLabel
+	Interfaces map[string][][]InterfaceInfo
+	// The flows grouped by where their probes ended, and how
+	PathEnds []*PathEnd
 }
 
 func newReport() (report Report) {
 	report.Paths = make(map[string][]string)
 	report.Sent = make(map[string][]int)
 	report.Rcvd = make(map[string][]int)
+	report.RTT = make(map[string][]RTTStats)
+	report.Loss = make(map[string][]LossInterval)
+	report.Anomalies = make(map[string][]LatencyAnomaly)
+	report.Breaks = make(map[string]*LossBreak)
+	report.Explanations = make(map[string]string)
+	report.NonResponding = make(map[string][]int)
+	report.ICMP = make(map[string][]*ICMPError)
+	report.Outcomes = make(map[string]*PathOutcome)
+	report.MPLS = make(map[string][][]MPLSLabel)
+	report.Interfaces = make(map[string][][]InterfaceInfo)
 
 	return report
 }
@@ -557,13 +889,64 @@ func newReport() (report Report) {
 //
 // Raw Json output for external program to analyze
 //
-func printLossyPathsJSON(sent, rcvd map[int] /* src port */ []int, hops map[int] /* src port */ []string, maxTTL int) {
+func printLossyPathsJSON(a *analysis) {
 	var report = newReport()
 
-	for srcPort, path := range hops {
+	report.Detector = *detectorName
+	report.SilentHops = a.silentHops
+	report.RateLimits = a.rateLimits
+	report.Calibration = a.calibration
+	report.Graph = a.graph
+	report.LinkLoss = a.linkLoss
+	report.Blame = a.blame
+	report.Flaps = a.flaps
+	report.Balancers = a.balancers
+	report.Loops = a.loops
+	report.PathEnds = a.ends
+
+	for srcPort, b := range a.breaks {
+		report.Breaks[fmt.Sprintf("%d", srcPort)] = b
+	}
+
+	for srcPort, list := range a.anomalies {
+		report.Anomalies[fmt.Sprintf("%d", srcPort)] = list
+	}
+
+	for srcPort, outcome := range a.outcomes {
+		report.Outcomes[fmt.Sprintf("%d", srcPort)] = outcome
+	}
+
+	for srcPort, path := range a.hops {
 		report.Paths[fmt.Sprintf("%d", srcPort)] = path
-		report.Sent[fmt.Sprintf("%d", srcPort)] = sent[srcPort]
-		report.Rcvd[fmt.Sprintf("%d", srcPort)] = rcvd[srcPort]
+		report.Sent[fmt.Sprintf("%d", srcPort)] = a.sent[srcPort]
+		report.Rcvd[fmt.Sprintf("%d", srcPort)] = a.rcvd[srcPort]
+		report.RTT[fmt.Sprintf("%d", srcPort)] = a.rtts[srcPort]
+		report.Loss[fmt.Sprintf("%d", srcPort)] = a.losses[srcPort]
+		report.ICMP[fmt.Sprintf("%d", srcPort)] = a.icmpErrors[srcPort]
+		// only the source ports with some hop telling its label stack or its interfaces
+		labels := make([][]MPLSLabel, len(a.extensions[srcPort]))
+		interfaces := make([][]InterfaceInfo, len(a.extensions[srcPort]))
+		var hasLabels, hasInterfaces bool
+		for i, ext := range a.extensions[srcPort] {
+			if ext.empty() {
+				continue
+			}
+			labels[i], interfaces[i] = ext.labels, ext.interfaces
+			hasLabels = hasLabels || len(ext.labels) > 0
+			hasInterfaces = hasInterfaces || len(ext.interfaces) > 0
+		}
+		if hasLabels {
+			report.MPLS[fmt.Sprintf("%d", srcPort)] = labels
+		}
+		if hasInterfaces {
+			report.Interfaces[fmt.Sprintf("%d", srcPort)] = interfaces
+		}
+		report.Explanations[fmt.Sprintf("%d", srcPort)] = a.verdicts[srcPort].Explanation
+		for ttl, name := range path {
+			if name == nonResponding {
+				report.NonResponding[fmt.Sprintf("%d", srcPort)] = append(report.NonResponding[fmt.Sprintf("%d", srcPort)], ttl+1)
+			}
+		}
 	}
 
 	b, err := json.MarshalIndent(report, "", "\t")
@@ -580,7 +963,19 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Must specify a target\n")
 		return
 	}
-	target := flag.Arg(0)
+	// the hops are told apart by address, and so is the target
+	targetAddr, err := resolveName(flag.Arg(0), *addrFamily)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not resolve target %s: %s\n", flag.Arg(0), err)
+		return
+	}
+	target := targetAddr.String()
+
+	// the DNS names of all the responders, by address
+	names := make(map[string]string)
+	if target != flag.Arg(0) {
+		names[target] = flag.Arg(0)
+	}
 
 	var probes []chan interface{}
 
@@ -591,6 +986,32 @@ func main() {
 		return
 	}
 
+	if *probeTimeout <= 0 {
+		fmt.Fprintf(os.Stderr, "Probe timeout must be positive\n")
+		return
+	}
+
+	if *mdaConfidence <= 0 || *mdaConfidence >= 1 {
+		fmt.Fprintf(os.Stderr, "MDA confidence must be between 0 and 1\n")
+		return
+	}
+
+	if *lbDestinations < 0 {
+		fmt.Fprintf(os.Stderr, "Number of load balancing destinations must not be negative\n")
+		return
+	}
+
+	if *significance <= 0 || *significance >= 1 {
+		fmt.Fprintf(os.Stderr, "Significance level must be between 0 and 1\n")
+		return
+	}
+
+	detector, err := newDetector(*detectorName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return
+	}
+
 	source, err := getSourceAddr(*addrFamily, *srcAddr)
 
 	if err != nil {
@@ -601,44 +1022,185 @@ func main() {
 	fmt.Fprintf(os.Stderr, "Starting fbtracert with %d probes per second/ttl, base src port %d and with the port span of %d\n", *probeRate, *baseSrcPort, *maxSrcPorts)
 	fmt.Fprintf(os.Stderr, "Use '-logtostderr=true' cmd line option to see GLOG output\n")
 
-	// this will catch senders quitting - we have one sender per ttl
-	senderDone := make([]chan struct{}, *maxTTL)
-	for ttl := *minTTL; ttl <= *maxTTL; ttl++ {
-		senderDone[ttl-1] = make(chan struct{})
-		c, err := Sender(senderDone[ttl-1], source, *addrFamily, target, *targetPort, *baseSrcPort, *maxSrcPorts, numIters, ttl, *probeRate, *tosValue)
+	// in unprivileged mode all senders share one connected UDP socket per source port
+	var pool *udpSocketPool
+	if *unprivileged {
+		if *probeType != "udp" {
+			fmt.Fprintf(os.Stderr, "Unprivileged mode only supports udp probes\n")
+			return
+		}
+		pool, err = newUDPSocketPool(*addrFamily, source, targetAddr, *targetPort, *baseSrcPort, *maxSrcPorts, *tosValue)
 		if err != nil {
-			glog.Fatalf("Failed to start sender for ttl %d, %s\n -- are you running with the correct privileges?", ttl, err)
+			fmt.Fprintf(os.Stderr, "Could not open UDP sockets: %s\n", err)
 			return
 		}
-		probes = append(probes, c)
 	}
 
+	// the flows we trace, MDA may pick only some of them
+	var srcPorts []int
+	for srcPort := *baseSrcPort; srcPort < *baseSrcPort+*maxSrcPorts; srcPort++ {
+		srcPorts = append(srcPorts, srcPort)
+	}
+
+	// every probe sent is tracked here until answered or expired
+	table := newProbeTable(time.Duration(*probeTimeout) * time.Millisecond)
+
+	// the senders stop probing the flows caught in forwarding loops past the loop
+	limits := newProbeLimits()
+
+	// start a sender for the given ttl, at the given rate or at the probe rate
+	startSenderAt := func(pps int) senderFunc {
+		return func(done <-chan struct{}, ttl int, srcPorts []int, iters int) (chan interface{}, error) {
+			if *unprivileged {
+				return UnprivilegedSender(done, table, limits, pool, srcPorts, iters, ttl, pps)
+			}
+			return Sender(done, table, limits, source, *addrFamily, target, *probeType, *targetPort, srcPorts, iters, ttl, pps, *tosValue)
+		}
+	}
+	startSender := startSenderAt(*probeRate)
+
+	// start a sender towards some other destination; in unprivileged mode we can only send to the target
+	startSenderTo := func(dest string) senderFunc {
+		if *unprivileged || dest == target {
+			return startSender
+		}
+		return func(done <-chan struct{}, ttl int, srcPorts []int, iters int) (chan interface{}, error) {
+			return Sender(done, table, limits, source, *addrFamily, dest, *probeType, *targetPort, srcPorts, iters, ttl, *probeRate, *tosValue)
+		}
+	}
+
+	// the addresses next to the target probed for the load balancer classification; in unprivileged mode we can only probe the target
+	var lbDests []string
+	if *classifyLB && !*unprivileged {
+		lbDests = neighbourAddrs(*targetAddr, *lbDestinations)
+	}
+
+	// the packets the receivers threw away, and why
+	drops := newDropStats()
+
 	// channel to tell receivers to stop
 	recvDone := make(chan struct{})
 
-	// collect ICMP unreachable messages for our probes
-	icmpResp, err := ICMPReceiver(recvDone, *addrFamily)
-	if err != nil {
-		return
+	go table.run(recvDone)
+
+	var responses []chan interface{}
+
+	if *unprivileged {
+		// the kernel queues the ICMP errors for our probes on their sockets
+		errResp, err := ErrQueueReceiver(recvDone, *addrFamily, pool, *maxTTL)
+		if err != nil {
+			glog.Errorf("Failed to start error queue receiver: %s\n", err)
+			return
+		}
+		responses = append(responses, errResp)
+	} else {
+		// collect ICMP unreachable messages for our probes
+		proto, err := probeProtocol(*addrFamily, *probeType)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return
+		}
+		icmpResp, err := ICMPReceiver(recvDone, *addrFamily, drops, proto, source, target, append([]string{target}, lbDests...), *baseSrcPort, *baseSrcPort+*maxSrcPorts, *maxTTL)
+		if err != nil {
+			return
+		}
+		responses = append(responses, icmpResp)
 	}
 
-	// collect TCP RST's from the target
-	targetAddr, err := resolveName(target, *addrFamily)
-	tcpResp, err := TCPReceiver(recvDone, *addrFamily, targetAddr.String(), *baseSrcPort, *baseSrcPort+*maxSrcPorts, *targetPort, *maxTTL)
-	if err != nil {
-		return
+	// collect TCP RST's from the target, UDP and ICMP probes are answered over ICMP
+	if *probeType == "tcp" && !*unprivileged {
+		tcpResp, err := TCPReceiver(recvDone, *addrFamily, drops, target, *baseSrcPort, *baseSrcPort+*maxSrcPorts, *targetPort, *maxTTL)
+		if err != nil {
+			return
+		}
+		responses = append(responses, tcpResp)
 	}
 
-	// add DNS name resolvers to the mix
+	// add DNS name resolvers to the mix, unless we only show addresses
 	var resolved []chan interface{}
-	unresolved := merge(tcpResp, icmpResp)
+	unresolved := merge(responses...)
+	allResolved := unresolved
 
-	for i := 0; i < *numResolvers; i++ {
-		c, err := Resolver(unresolved)
+	if !*numeric {
+		for i := 0; i < *numResolvers; i++ {
+			c, err := Resolver(unresolved)
+			if err != nil {
+				return
+			}
+			resolved = append(resolved, c)
+		}
+		allResolved = merge(resolved...)
+	}
+
+	// measure the response ceiling of the target before it sees any other probes
+	var calibration *Calibration
+	if *calibrateTarget {
+		calibration, err = calibrate(table, allResolved, startSenderAt, *maxTTL, srcPorts, *probeRate, *significance)
 		if err != nil {
+			glog.Fatalf("Failed to start calibration sender, %s\n -- are you running with the correct privileges?", err)
 			return
 		}
-		resolved = append(resolved, c)
+		if calibration.SlowSent == 0 || calibration.Sent == 0 {
+			glog.Warningf("No calibration probes were sent, the hit rates of the target are left as they are\n")
+		}
+		glog.Infof("Target answered %d out of %d calibration probes at %d pps, and %d out of %d at %d pps\n", calibration.SlowRcvd, calibration.SlowSent, calibration.SlowRate, calibration.Rcvd, calibration.Sent, calibration.Rate)
+	}
+
+	// the exploration below takes its time out of the run time
+	exploreStart := time.Now()
+
+	// find the flows covering all paths, and spend the rest of the time measuring loss over them
+	if *mda {
+		flows, _, spent, err := exploreMDA(table, allResolved, startSender, target, srcPorts, *minTTL, *maxTTL, *mdaConfidence)
+		if err != nil {
+			glog.Fatalf("Failed to start MDA sender, %s\n -- are you running with the correct privileges?", err)
+			return
+		}
+		glog.Infof("MDA picked %d flows out of %d, spending %d probes in %s\n", len(flows), len(srcPorts), spent, time.Since(exploreStart))
+		if len(flows) == 0 {
+			fmt.Fprintf(os.Stderr, "MDA did not find any paths to the target\n")
+			return
+		}
+		srcPorts = flows
+	}
+
+	// tell how the branching points spread the traffic
+	var balancers []*Balancer
+	if *classifyLB {
+		if *unprivileged {
+			glog.Warningf("Unprivileged mode only probes the target, per-destination load balancing is not checked\n")
+		}
+		var spent int
+		balancers, spent, err = classifyBalancers(table, allResolved, startSenderTo, target, lbDests, srcPorts, *minTTL, *maxTTL)
+		if err != nil {
+			glog.Fatalf("Failed to start load balancer classification sender, %s\n -- are you running with the correct privileges?", err)
+			return
+		}
+		glog.Infof("Found %d load balancers, spending %d probes\n", len(balancers), spent)
+	}
+
+	if *mda || *classifyLB {
+		remaining := time.Duration(*maxTime)*time.Second - time.Since(exploreStart)
+		numIters = int(remaining.Seconds() * float64(*probeRate) / float64(len(srcPorts)))
+		if numIters <= 1 {
+			fmt.Fprintf(os.Stderr, "Exploration took all the time, increase run time or decrease src port range...\n")
+			return
+		}
+	}
+
+	// the hop changes of every source port are kept along with their times
+	flaps := newFlapRecorder(monotime())
+
+	// this will catch senders quitting - we have one sender per ttl
+	senderDone := make([]chan struct{}, *maxTTL)
+	for ttl := *minTTL; ttl <= *maxTTL; ttl++ {
+		senderDone[ttl-1] = make(chan struct{})
+		c, err := startSender(senderDone[ttl-1], ttl, srcPorts, numIters)
+		if err != nil {
+			glog.Fatalf("Failed to start sender for ttl %d, %s\n -- are you running with the correct privileges?", ttl, err)
+			return
+		}
+		probes = append(probes, c)
 	}
 
 	// maps that store various counters per source port/ttl
@@ -647,15 +1209,32 @@ func main() {
 	sent := make(map[int] /*src Port */ []int /* pkts sent */)
 	rcvd := make(map[int] /*src Port */ []int /* pkts rcvd */)
 	hops := make(map[int] /*src Port */ []string /* hop name */)
-
-	for srcPort := *baseSrcPort; srcPort < *baseSrcPort+*maxSrcPorts; srcPort++ {
+	rtts := make(map[int] /*src Port */ [][]time.Duration /* rtt samples */)
+	// per-second probe and response counts, to tell rate-limited responders apart
+	sentBins := make(map[int] /*src Port */ []rateBins /* pkts sent per second */)
+	hopAddrs := make(map[int] /*src Port */ []string /* hop address */)
+	rcvdBins := make(map[int] /*src Port */ []rateBins /* pkts rcvd per second */)
+	// the ICMP error type and code of the latest response
+	hopErrors := make(map[int] /*src Port */ []*ICMPError)
+	// the MPLS label stack and the interfaces of the latest response carrying any
+	hopExtensions := make(map[int] /*src Port */ []*icmpExtensions)
+
+	for _, srcPort := range srcPorts {
 		sent[srcPort] = make([]int, *maxTTL)
 		rcvd[srcPort] = make([]int, *maxTTL)
 		hops[srcPort] = make([]string, *maxTTL)
+		rtts[srcPort] = make([][]time.Duration, *maxTTL)
+		sentBins[srcPort] = make([]rateBins, *maxTTL)
+		rcvdBins[srcPort] = make([]rateBins, *maxTTL)
+		hopAddrs[srcPort] = make([]string, *maxTTL)
+		hopErrors[srcPort] = make([]*ICMPError, *maxTTL)
+		hopExtensions[srcPort] = make([]*icmpExtensions, *maxTTL)
 		//hops[srcPort][*maxTTL-1] = target
 
 		for i := 0; i < *maxTTL; i++ {
 			hops[srcPort][i] = "?"
+			sentBins[srcPort][i] = make(rateBins)
+			rcvdBins[srcPort][i] = make(rateBins)
 		}
 	}
 
@@ -665,107 +1244,411 @@ func main() {
 		for val := range merge(probes...) {
 			probe := val.(Probe)
 			sent[probe.srcPort][probe.ttl-1]++
+			sentBins[probe.srcPort][probe.ttl-1].add(monotime())
 		}
 		glog.V(2).Infoln("All senders finished!")
 		// give receivers time to catch up on in-flight data
-		time.Sleep(2 * time.Second)
+		table.drain()
 		// tell receivers to stop receiving
 		close(recvDone)
 	}()
 
-	// this store DNS names of all nodes that ever replied to us
-	var names []string
-
 	// src ports that changed their paths in process of tracing
 	var flappedPorts = make(map[int]bool)
 
 	lastClosed := *maxTTL
-	for val := range merge(resolved...) {
+
+	// the probe made it all the way to the target
+	targetReached := func(probe Probe, received int64, rtt time.Duration) {
+		// stop all senders sending above this ttl, since they are not needed
+		// XXX: this is not always optimal, i.e. we may receive TCP RST for
+		// a port mapped to a short WAN path, and it would tell us to terminate
+		// probing at higher TTL, thus cutting visibility on "long" paths
+		// however, this mostly concerned that last few hops...
+		for i := probe.ttl; i < lastClosed; i++ {
+			close(senderDone[i])
+		}
+		// update the last closed ttl, so we don't double-close the channels
+		if probe.ttl < lastClosed {
+			lastClosed = probe.ttl
+		}
+		rcvd[probe.srcPort][probe.ttl-1]++
+		rtts[probe.srcPort][probe.ttl-1] = append(rtts[probe.srcPort][probe.ttl-1], rtt)
+		if flaps.observe(probe.srcPort, probe.ttl, target, received) {
+			glog.V(2).Infof("%d: Source port %d flapped at ttl %d from: %s to the target\n", time.Now().UnixNano()/(1000*1000), probe.srcPort, probe.ttl, hops[probe.srcPort][probe.ttl-1])
+			flappedPorts[probe.srcPort] = true
+		}
+		hops[probe.srcPort][probe.ttl-1] = target
+		hopErrors[probe.srcPort][probe.ttl-1] = nil
+	}
+
+	// match the response against the probe table and find its rtt;
+	// duplicate, late and unknown responses are not counted
+	accept := func(probe Probe, received int64) (time.Duration, bool) {
+		rtt, status := table.match(probe, received)
+		switch status {
+		case matchDuplicate:
+			glog.V(2).Infof("Duplicate response for source port %d ttl %d\n", probe.srcPort, probe.ttl)
+		case matchLate:
+			glog.V(2).Infof("Late response for source port %d ttl %d after %s\n", probe.srcPort, probe.ttl, rtt)
+		case matchUnknown:
+			glog.V(2).Infof("Unexpected response for source port %d ttl %d\n", probe.srcPort, probe.ttl)
+		}
+		return rtt, status == matchOK
+	}
+
+	for val := range allResolved {
+		var ok bool
 		switch val.(type) {
 		case ICMPResponse:
 			resp := val.(ICMPResponse)
+			if resp.rtt, ok = accept(resp.Probe, resp.received); !ok {
+				continue
+			}
 			rcvd[resp.srcPort][resp.ttl-1]++
-			currName := hops[resp.srcPort][resp.ttl-1]
-			if currName != "?" && currName != resp.fromName {
-				glog.V(2).Infof("%d: Source port %d flapped at ttl %d from: %s to %s\n", time.Now().UnixNano()/(1000*1000), resp.srcPort, resp.ttl, currName, resp.fromName)
+			rtts[resp.srcPort][resp.ttl-1] = append(rtts[resp.srcPort][resp.ttl-1], resp.rtt)
+			// the hops are kept by address, names may not resolve every time
+			addr := resp.fromAddr.String()
+			currAddr := hops[resp.srcPort][resp.ttl-1]
+			if flaps.observe(resp.srcPort, resp.ttl, addr, resp.received) {
+				glog.V(2).Infof("%d: Source port %d flapped at ttl %d from: %s to %s\n", time.Now().UnixNano()/(1000*1000), resp.srcPort, resp.ttl, currAddr, addr)
 				flappedPorts[resp.srcPort] = true
 			}
-			hops[resp.srcPort][resp.ttl-1] = resp.fromName
-			// accumulate all names for processing later
-			// XXX: we may have duplicates, which is OK,
-			// but not very efficient
-			names = append(names, resp.fromName)
+			hops[resp.srcPort][resp.ttl-1] = addr
+			hopAddrs[resp.srcPort][resp.ttl-1] = addr
+			hopErrors[resp.srcPort][resp.ttl-1] = resp.icmpError
+			// the extensions describe the responder: keep the latest ones it sent, and forget them once another one answers
+			if addr != currAddr || !resp.extensions.empty() {
+				hopExtensions[resp.srcPort][resp.ttl-1] = resp.extensions
+			}
+			switch {
+			case resp.icmpError.terminal():
+				// the probes with higher ttls are stopped right there as well
+				if limits.allowed(resp.srcPort, resp.ttl+1) {
+					glog.V(1).Infof("Source port %d stopped by %s at ttl %d with %s, not probing it any further\n", resp.srcPort, addr, resp.ttl, resp.icmpError)
+					limits.limit(resp.srcPort, resp.ttl)
+				}
+			case !flappedPorts[resp.srcPort]:
+				// the ports changing their paths may look like looping, just as they are left out of loss detection
+				if end := loopEnd(hopAddrs[resp.srcPort], resp.ttl); end > 0 && limits.allowed(resp.srcPort, end+1) {
+					glog.V(1).Infof("Source port %d loops back to %s at ttl %d, not probing it any further\n", resp.srcPort, addr, end)
+					limits.limit(resp.srcPort, end)
+				}
+			}
+			rcvdBins[resp.srcPort][resp.ttl-1].add(resp.received)
+			if resp.fromName != "" {
+				names[addr] = resp.fromName
+			}
 		case TCPResponse:
 			resp := val.(TCPResponse)
-			// stop all senders sending above this ttl, since they are not needed
-			// XXX: this is not always optimal, i.e. we may receive TCP RST for
-			// a port mapped to a short WAN path, and it would tell us to terminate
-			// probing at higher TTL, thus cutting visibility on "long" paths
-			// however, this mostly concerned that last few hops...
-			for i := resp.ttl; i < lastClosed; i++ {
-				close(senderDone[i])
-			}
-			// update the last closed ttl, so we don't double-close the channels
-			if resp.ttl < lastClosed {
-				lastClosed = resp.ttl
+			if resp.rtt, ok = accept(resp.Probe, resp.received); !ok {
+				continue
 			}
-			rcvd[resp.srcPort][resp.ttl-1]++
-			hops[resp.srcPort][resp.ttl-1] = target
+			targetReached(resp.Probe, resp.received, resp.rtt)
+		case UDPResponse:
+			resp := val.(UDPResponse)
+			if resp.rtt, ok = accept(resp.Probe, resp.received); !ok {
+				continue
+			}
+			targetReached(resp.Probe, resp.received, resp.rtt)
+		case EchoResponse:
+			resp := val.(EchoResponse)
+			if resp.rtt, ok = accept(resp.Probe, resp.received); !ok {
+				continue
+			}
+			targetReached(resp.Probe, resp.received, resp.rtt)
 		}
 	}
 
+	counts := table.stats()
+	glog.Infof("%d probes answered, %d timed out; %d late, %d duplicate and %d unexpected responses\n",
+		counts.answered, counts.timedOut, counts.late, counts.duplicates, counts.unknown)
+	if drops.total() > 0 {
+		glog.Infof("%d packets dropped by the receivers: %s\n", drops.total(), drops)
+	}
+
+	// cut the per-ttl vectors of a source port down to the given number of ttls; the hops are read up to the length of sent
+	truncate := func(srcPort, ttls int) {
+		if ttls >= len(sent[srcPort]) {
+			return
+		}
+		sent[srcPort] = sent[srcPort][:ttls]
+		rcvd[srcPort] = rcvd[srcPort][:ttls]
+		rtts[srcPort] = rtts[srcPort][:ttls]
+		hopErrors[srcPort] = hopErrors[srcPort][:ttls]
+		hopExtensions[srcPort] = hopExtensions[srcPort][:ttls]
+	}
+
 	for srcPort, hopVector := range hops {
 		for i := range hopVector {
-			// truncate lists once we hit the target name
-			if hopVector[i] == target && i < *maxTTL-1 {
-				sent[srcPort] = sent[srcPort][:i+1]
-				rcvd[srcPort] = rcvd[srcPort][:i+1]
-				hopVector = hopVector[:i+1]
+			// truncate lists once we hit the target name, or a hop that stops the probes
+			stopped := hopErrors[srcPort][i] != nil && hopErrors[srcPort][i].terminal()
+			if (hopVector[i] == target || stopped) && i < *maxTTL-1 {
+				truncate(srcPort, i+1)
 				break
 			}
 		}
 	}
 
+	// from now on the hops are shown by address, along with their names
+	label := func(addr string) string {
+		return hopLabel(addr, names[addr])
+	}
+	for _, hopVector := range hops {
+		for i := range hopVector {
+			hopVector[i] = label(hopVector[i])
+		}
+	}
+	for _, b := range balancers {
+		b.Name = label(b.Name)
+		for i := range b.NextHops {
+			b.NextHops[i] = label(b.NextHops[i])
+		}
+	}
+
+	// the probes of the flows caught in a loop never get further than going around it once
+	pathAddrs := make(map[int] /*src port*/ []string)
+	for srcPort, sentVector := range sent {
+		pathAddrs[srcPort] = hopAddrs[srcPort][:len(sentVector)]
+	}
+	loops := findLoops(pathAddrs, hops)
+	for _, loop := range loops {
+		glog.Infof("%d source ports loop between ttl %d and %d\n", len(loop.Flows), loop.Start, loop.End)
+		for _, srcPort := range loop.Flows {
+			truncate(srcPort, loop.End)
+		}
+	}
+	// the ports stopped while tracing were not probed any further, whatever their hops look like by now
+	for srcPort := range sent {
+		if max := limits.max(srcPort); max > 0 {
+			truncate(srcPort, max)
+		}
+	}
+
+	// where the probes of every flow ended: at the target, at a hop rejecting them, or nowhere in particular
+	outcomes := make(map[int] /*src port*/ *PathOutcome)
+	for srcPort, sentVector := range sent {
+		outcomes[srcPort] = pathOutcome(hops[srcPort][:len(sentVector)], hopErrors[srcPort], label(target))
+	}
+	ends := summarizeOutcomes(outcomes)
+	for _, end := range ends {
+		if end.Error != nil {
+			glog.Infof("%d source ports ended at ttl %d on %s, %s: %s\n", len(end.Flows), end.TTL, end.Hop, end.Outcome, end.Error)
+		}
+	}
+
+	// the ports balanced per packet still measure the loss of their hops, just over more than one router
+	// at some ttls; the ports that moved to another path while tracing cannot tell where the loss is
+	flapHistories := flaps.histories(label)
+	unstablePorts := make(map[int]bool)
+	for _, h := range flapHistories {
+		if h.Behaviour != flapPerPacket {
+			unstablePorts[h.SrcPort] = true
+		}
+	}
+	for _, h := range flapHistories {
+		if !unstablePorts[h.SrcPort] && h.TTL-1 < len(hops[h.SrcPort]) {
+			hops[h.SrcPort][h.TTL-1] = strings.Join(flapHopNames(h), " | ")
+		}
+	}
 	if len(flappedPorts) > 0 {
-		glog.Infof("A total of %d ports out of %d changed their paths while tracing\n", len(flappedPorts), *maxSrcPorts)
+		glog.Infof("A total of %d ports out of %d changed their paths while tracing, %d of them left out of loss detection\n", len(flappedPorts), len(srcPorts), len(unstablePorts))
 	}
 
 	lossyPathSent := make(map[int] /*src port */ []int)
 	lossyPathRcvd := make(map[int] /* src port */ []int)
 	lossyPathHops := make(map[int] /*src port*/ []string)
+	lossyPathRTT := make(map[int] /*src port*/ []RTTStats)
+	lossyPathLoss := make(map[int] /*src port*/ []LossInterval)
+	lossyPathBreaks := make(map[int] /*src port*/ *LossBreak)
 
-	// process the accumulated data, find and output lossy paths
+	// summarize the RTT samples and look for paths getting slower than their siblings
+	pathHops := make(map[int] /*src port*/ []string)
+	pathRTT := make(map[int] /*src port*/ []RTTStats)
 	for port, sentVector := range sent {
-		if flappedPorts[port] {
+		if unstablePorts[port] {
 			continue
 		}
-		if rcvdVector, ok := rcvd[port]; ok {
-			norm, err := normalizeRcvd(sentVector, rcvdVector)
+		pathHops[port] = hops[port][:len(sentVector)]
+		pathRTT[port] = make([]RTTStats, len(sentVector))
+		for i := range sentVector {
+			pathRTT[port][i] = computeRTTStats(rtts[port][i])
+		}
+	}
+	anomalies := findLatencyAnomalies(pathHops, pathRTT, time.Duration(*latencyThreshold*float64(time.Millisecond)))
 
-			if err != nil {
-				glog.Errorf("Could not normalize %v / %v", rcvdVector, sentVector)
-				continue
-			}
+	// routers that never answer are not lossy, keep them out of the loss detection
+	silent := findSilentHops(sent, rcvd)
+	silentHops := summarizeSilentHops(sent, silent)
+	for _, hop := range silentHops {
+		glog.Infof("TTL %d did not respond on %d out of %d paths\n", hop.TTL, hop.Ports, hop.Paths)
+	}
 
-			if isLossy(norm) || *showAll {
-				hosts := make([]string, len(norm))
-				for i := range norm {
-					hosts[i] = hops[port][i]
+	// neither are the routers policing their ICMP responses; the flows that changed
+	// their paths cannot tell which responder their probes were offered to
+	offeredBins := make(map[string] /* responder */ rateBins)
+	answeredBins := make(map[string] /* responder */ rateBins)
+	for port, sentVector := range sent {
+		if flappedPorts[port] {
+			continue
+		}
+		for i := range sentVector {
+			if addr := hopAddrs[port][i]; addr != "" {
+				if offeredBins[addr] == nil {
+					offeredBins[addr] = make(rateBins)
+					answeredBins[addr] = make(rateBins)
 				}
-				lossyPathSent[port] = sentVector
-				lossyPathRcvd[port] = rcvdVector
-				lossyPathHops[port] = hosts
+				offeredBins[addr].merge(sentBins[port][i])
+				answeredBins[addr].merge(rcvdBins[port][i])
 			}
+		}
+	}
+	rateLimits := findRateLimits(offeredBins, answeredBins)
+	for _, l := range rateLimits {
+		glog.Infof("%s rate limits its responses to %.1f per second\n", l.Responder, l.Ceiling)
+	}
+
+	excluded := make(map[int] /*src port*/ []bool)
+	for port, sentVector := range sent {
+		excluded[port] = make([]bool, len(sentVector))
+		for i := range sentVector {
+			excluded[port][i] = rateLimits[hopAddrs[port][i]] != nil || (i < len(silent[port]) && silent[port][i])
+		}
+	}
+
+	// process the accumulated data, find and output lossy paths
+	paths := make(map[int] /*src port*/ *PathData)
+	pathRcvd := make(map[int] /*src port*/ []int)
+	for port, sentVector := range sent {
+		if unstablePorts[port] {
+			continue
+		}
+		if rcvdVector, ok := rcvd[port]; ok {
+			// the target may be rate-limiting its responses
+			if pathHops[port][len(sentVector)-1] == label(target) {
+				rcvdVector = calibrateRcvd(sentVector, rcvdVector, calibration)
+			}
+			pathRcvd[port] = rcvdVector
+			paths[port] = excludeHops(newPathData(port, sentVector, rcvdVector, pathHops[port], pathRTT[port]), excluded[port])
 		} else {
 			glog.Errorf("No responses received for port %d", port)
 		}
 	}
 
-	if len(lossyPathHops) > 0 {
+	verdicts := detector.Detect(paths)
+
+	// hop names for the reports, telling the non-responding and rate-limited hops
+	displayHops := make(map[int] /*src port*/ []string)
+	for port := range paths {
+		hosts := make([]string, len(sent[port]))
+		copy(hosts, pathHops[port])
+		for i := range hosts {
+			if i < len(silent[port]) && silent[port][i] {
+				hosts[i] = nonResponding
+			}
+			if rateLimits[hopAddrs[port][i]] != nil {
+				hosts[i] += " (rate-limited)"
+			}
+		}
+		displayHops[port] = hosts
+	}
+
+	// merge the paths of all flows into the topology
+	graph := buildGraph(sent, rcvd, displayHops)
+	annotateBalancers(graph, balancers)
+	blame := rankBlame(displayHops, verdicts)
+
+	for port := range paths {
+		verdict := verdicts[port]
+		if verdict.Lossy {
+			lossyPathBreaks[port] = verdict.Break
+			glog.V(1).Infof("Source port %d: %s, %s\n", port, verdict.Break, verdict.Explanation)
+		}
+
+		if verdict.Lossy || len(anomalies[port]) > 0 || *showAll {
+			lossyPathSent[port] = sent[port]
+			lossyPathRcvd[port] = rcvd[port]
+			lossyPathHops[port] = displayHops[port]
+			lossyPathRTT[port] = pathRTT[port]
+			lossyPathLoss[port] = make([]LossInterval, len(sent[port]))
+			for i := range sent[port] {
+				lossyPathLoss[port][i] = lossInterval(sent[port][i], rcvd[port][i], *significance)
+			}
+		}
+	}
+
+	// the link loss only matters when some path is lossy, or along with the graph
+	var linkLoss []LinkLoss
+	if len(lossyPathBreaks) > 0 || *showGraph {
+		linkLoss = estimateLinkLoss(sent, pathRcvd, displayHops, excluded, *significance)
+	}
+
+	a := &analysis{
+		sent:        lossyPathSent,
+		rcvd:        lossyPathRcvd,
+		hops:        lossyPathHops,
+		rtts:        lossyPathRTT,
+		losses:      lossyPathLoss,
+		anomalies:   anomalies,
+		breaks:      lossyPathBreaks,
+		verdicts:    verdicts,
+		silentHops:  silentHops,
+		rateLimits:  rateLimits,
+		calibration: calibration,
+		graph:       graph,
+		linkLoss:    linkLoss,
+		blame:       blame,
+		flaps:       flapHistories,
+		balancers:   balancers,
+		loops:       loops,
+		icmpErrors:  hopErrors,
+		extensions:  hopExtensions,
+		outcomes:    outcomes,
+		ends:        ends,
+		maxTTL:      lastClosed + 1,
+	}
+
+	if len(a.hops) > 0 || len(a.flaps) > 0 || len(a.balancers) > 0 || len(a.loops) > 0 || stoppedFlows(a.ends) || *showGraph {
 		if *jsonOutput {
-			printLossyPathsJSON(lossyPathSent, lossyPathRcvd, lossyPathHops, lastClosed+1)
+			printLossyPathsJSON(a)
 		} else {
-			printLossyPaths(lossyPathSent, lossyPathRcvd, lossyPathHops, *maxColumns, lastClosed+1)
+			printLossyPaths(a, *maxColumns)
+			if len(a.breaks) > 0 {
+				printVerdicts(a.verdicts)
+			}
+			if len(a.silentHops) > 0 {
+				printSilentHops(a.silentHops)
+			}
+			if len(a.rateLimits) > 0 {
+				printRateLimits(a.rateLimits)
+			}
+			if a.calibration != nil {
+				printCalibration(a.calibration)
+			}
+			if len(a.flaps) > 0 {
+				printFlaps(a.flaps)
+			}
+			if len(a.loops) > 0 {
+				printLoops(a.loops)
+			}
+			if stoppedFlows(a.ends) {
+				printOutcomes(a.ends)
+			}
+			if len(a.anomalies) > 0 {
+				printLatencyAnomalies(a.anomalies)
+			}
+			if len(a.balancers) > 0 {
+				printBalancers(a.balancers)
+			}
+			if *showGraph {
+				printGraph(a.graph)
+			}
+			if len(a.breaks) > 0 || *showGraph {
+				printLinkLoss(a.linkLoss)
+			}
+			if len(a.blame) > 0 {
+				printBlame(a.blame)
+			}
 		}
 		return
 	}
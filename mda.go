@@ -0,0 +1,284 @@
+/**
+ * Copyright (c) 2016-present, Facebook, Inc.
+ * All rights reserved.
+ *
+ * This source code is licensed under the BSD-style license found in the
+ * LICENSE file in the root directory of this source tree. An additional grant
+ * of patent rights can be found in the PATENTS file in the same directory.
+ */
+
+package main
+
+import (
+	"math"
+	"sort"
+
+	"github.com/golang/glog"
+)
+
+// the responder recorded for a flow that got no answer at some ttl
+const mdaNoAnswer = "*"
+
+//
+// The number of flows we need to send through a node, having seen k of its next hops, to rule out
+// with the given failure probability that it has k+1 or more of them: the smallest n such that
+// (k+1)(k/(k+1))^n <= alpha, as in the Multipath Detection Algorithm of Augustin et al.
+//
+func mdaStoppingPoint(k int, alpha float64) int {
+	if k < 1 {
+		k = 1
+	}
+	n := 1
+	for float64(k+1)*math.Pow(float64(k)/float64(k+1), float64(n)) > alpha {
+		n++
+	}
+	return n
+}
+
+// mdaExplorer keeps the state of the adaptive flow exploration
+type mdaExplorer struct {
+	table  *ProbeTable
+	in     <-chan interface{}
+	start  senderFunc
+	alpha  float64
+	maxTTL int
+	target string
+
+	// source ports not used yet
+	pool []int
+	// the responder per ttl-1 for every flow explored, "" if never probed at that ttl
+	paths map[int] /* src port */ []string
+	// the flows that made it to the target, and at which ttl
+	reached map[int] /* src port */ int
+	// probes spent on the exploration
+	sent int
+}
+
+// Take up to n flows that were never used before
+func (m *mdaExplorer) newFlows(n int) []int {
+	if n > len(m.pool) {
+		n = len(m.pool)
+	}
+	flows := m.pool[:n]
+	m.pool = m.pool[n:]
+	for _, flow := range flows {
+		m.paths[flow] = make([]string, m.maxTTL)
+	}
+	return flows
+}
+
+// Probe the flows at the given ttl once, and record who answered
+func (m *mdaExplorer) probe(ttl int, flows []int) error {
+	responses, sent, err := probeRound(m.table, m.in, m.start, ttl, flows, 1)
+	if err != nil {
+		return err
+	}
+	m.sent += sent
+
+	for _, flow := range flows {
+		m.paths[flow][ttl-1] = mdaNoAnswer
+		for _, resp := range responses[flow] {
+			m.paths[flow][ttl-1] = resp.addr
+			if resp.target {
+				m.paths[flow][ttl-1] = m.target
+				if _, ok := m.reached[flow]; !ok {
+					m.reached[flow] = ttl
+				}
+			}
+		}
+	}
+	return nil
+}
+
+//
+// Explore the flows at one ttl until every node at the previous ttl has had enough flows through it
+// to discover all of its next hops at the requested confidence. The flows are grouped by the node they
+// cross at the previous ttl; when a group is short of flows we pull new flows from the pool and find
+// out where they cross the previous ttl first. Returns false once every flow probed here hit the target
+//
+func (m *mdaExplorer) exploreTTL(ttl, minTTL int) (bool, error) {
+	for {
+		groups := make(map[string][]int)
+		if ttl == minTTL {
+			// all flows start from us
+			groups[""] = nil
+		}
+		for flow, path := range m.paths {
+			if ttl == minTTL {
+				groups[""] = append(groups[""], flow)
+				continue
+			}
+			// the flows crossing a silent node are grouped together, we cannot tell them apart
+			pred := path[ttl-2]
+			if pred == "" {
+				continue
+			}
+			if reachedAt, ok := m.reached[flow]; ok && reachedAt < ttl {
+				continue
+			}
+			groups[pred] = append(groups[pred], flow)
+		}
+
+		var toProbe []int
+		deficit := 0
+		for _, flows := range groups {
+			sort.Ints(flows)
+
+			successors := make(map[string]bool)
+			var unprobed []int
+			probed := 0
+			for _, flow := range flows {
+				switch next := m.paths[flow][ttl-1]; {
+				case next == "":
+					unprobed = append(unprobed, flow)
+				case next == mdaNoAnswer:
+					probed++
+				default:
+					probed++
+					successors[next] = true
+				}
+			}
+
+			want := mdaStoppingPoint(len(successors), m.alpha) - probed
+			if want <= 0 {
+				continue
+			}
+			if want > len(unprobed) {
+				deficit += want - len(unprobed)
+				want = len(unprobed)
+			}
+			toProbe = append(toProbe, unprobed[:want]...)
+		}
+
+		switch {
+		case len(toProbe) > 0:
+			if err := m.probe(ttl, toProbe); err != nil {
+				return false, err
+			}
+		case deficit > 0 && len(m.pool) > 0:
+			// find out where the new flows cross the previous ttl, they join the groups next time around
+			flows := m.newFlows(deficit)
+			if ttl > minTTL {
+				if err := m.probe(ttl-1, flows); err != nil {
+					return false, err
+				}
+			}
+		default:
+			if deficit > 0 {
+				glog.Warningf("Ran out of source ports exploring ttl %d, some next hops may be missed\n", ttl)
+			}
+			// keep going unless every flow that got here reached the target
+			for _, flows := range groups {
+				for _, flow := range flows {
+					if reachedAt, ok := m.reached[flow]; !ok || reachedAt != ttl {
+						return true, nil
+					}
+				}
+			}
+			return false, nil
+		}
+	}
+}
+
+//
+// Explore the paths to the target adaptively with MDA, hop by hop, over the given source ports.
+// Returns the flows that cover every node and link discovered, which are then used to measure loss,
+// the responders seen per flow, and the number of probes spent
+//
+func exploreMDA(table *ProbeTable, in <-chan interface{}, start senderFunc, target string, srcPorts []int, minTTL, maxTTL int, confidence float64) ([]int, map[int] /* src port */ []string, int, error) {
+	m := &mdaExplorer{
+		table:   table,
+		in:      in,
+		start:   start,
+		alpha:   1 - confidence,
+		maxTTL:  maxTTL,
+		target:  target,
+		pool:    srcPorts,
+		paths:   make(map[int][]string),
+		reached: make(map[int]int),
+	}
+
+	for ttl := minTTL; ttl <= maxTTL; ttl++ {
+		more, err := m.exploreTTL(ttl, minTTL)
+		if err != nil {
+			return nil, nil, m.sent, err
+		}
+		glog.V(1).Infof("MDA explored ttl %d with %d flows, %d probes spent so far\n", ttl, len(m.paths), m.sent)
+		if !more {
+			break
+		}
+	}
+
+	return coverFlows(m.paths), m.paths, m.sent, nil
+}
+
+//
+// Pick the flows covering every node and link seen during the exploration, the flows
+// probed at most ttls first, so that loss measurement goes across all the paths discovered
+//
+func coverFlows(paths map[int] /* src port */ []string) []int {
+	type link struct {
+		ttl      int
+		from, to string
+	}
+
+	var flows flowsByKnownHops
+	for flow, path := range paths {
+		known := 0
+		for _, hop := range path {
+			if hop != "" && hop != mdaNoAnswer {
+				known++
+			}
+		}
+		flows = append(flows, flowKnownHops{flow: flow, known: known})
+	}
+	sort.Sort(flows)
+
+	covered := make(map[link]bool)
+	var result []int
+	for _, f := range flows {
+		flow := f.flow
+		fresh := false
+		for ttl, hop := range paths[flow] {
+			if hop == "" || hop == mdaNoAnswer {
+				continue
+			}
+			// a node is a link from nowhere
+			l := link{ttl: ttl, to: hop}
+			if !covered[l] {
+				covered[l] = true
+				fresh = true
+			}
+			if ttl > 0 && paths[flow][ttl-1] != "" && paths[flow][ttl-1] != mdaNoAnswer {
+				l = link{ttl: ttl, from: paths[flow][ttl-1], to: hop}
+				if !covered[l] {
+					covered[l] = true
+					fresh = true
+				}
+			}
+		}
+		if fresh {
+			result = append(result, flow)
+		}
+	}
+	sort.Ints(result)
+
+	return result
+}
+
+type flowKnownHops struct {
+	flow  int
+	known int
+}
+
+// flowsByKnownHops sorts the flows with more hops known first
+type flowsByKnownHops []flowKnownHops
+
+func (f flowsByKnownHops) Len() int      { return len(f) }
+func (f flowsByKnownHops) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+func (f flowsByKnownHops) Less(i, j int) bool {
+	if f[i].known != f[j].known {
+		return f[i].known > f[j].known
+	}
+	return f[i].flow < f[j].flow
+}
@@ -0,0 +1,77 @@
+/**
+ * Copyright (c) 2016-present, Facebook, Inc.
+ * All rights reserved.
+ *
+ * This source code is licensed under the BSD-style license found in the
+ * LICENSE file in the root directory of this source tree. An additional grant
+ * of patent rights can be found in the PATENTS file in the same directory.
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMDAStoppingPoint(t *testing.T) {
+	tests := []struct {
+		k     int
+		alpha float64
+		want  int
+	}{
+		// the stopping points of the MDA paper at 95% confidence
+		{1, 0.05, 6},
+		{2, 0.05, 11},
+		{3, 0.05, 16},
+		{4, 0.05, 21},
+		{5, 0.05, 27},
+		// no next hop seen yet counts as one
+		{0, 0.05, 6},
+		{1, 0.01, 8},
+	}
+
+	for _, test := range tests {
+		if got := mdaStoppingPoint(test.k, test.alpha); got != test.want {
+			t.Errorf("mdaStoppingPoint(%d, %v): got %d, want %d", test.k, test.alpha, got, test.want)
+		}
+	}
+}
+
+func TestCoverFlows(t *testing.T) {
+	tests := []struct {
+		name  string
+		paths map[int][]string
+		want  []int
+	}{
+		{"nothing explored", map[int][]string{}, nil},
+		{"single path", map[int][]string{
+			1: {"A", "B", "D"},
+			2: {"A", "B", "D"},
+			3: {"A", "B", "D"},
+		}, []int{1}},
+		{"diamond", map[int][]string{
+			1: {"A", "B", "D"},
+			2: {"A", "C", "D"},
+			3: {"A", "B", "D"},
+			4: {"A", "C", "D"},
+		}, []int{1, 2}},
+		{"links between the same nodes", map[int][]string{
+			1: {"A", "B", "D", "E"},
+			2: {"A", "C", "D", "E"},
+			3: {"A", "B", "D", "F"},
+			4: {"A", "C", "D", "F"},
+		}, []int{1, 2, 3}},
+		{"more known hops first", map[int][]string{
+			1: {"A", mdaNoAnswer, "D"},
+			2: {"A", "B", "D"},
+			3: {"A", "B", ""},
+		}, []int{2}},
+	}
+
+	for _, test := range tests {
+		if got := coverFlows(test.paths); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+/**
+ * Copyright (c) 2016-present, Facebook, Inc.
+ * All rights reserved.
+ *
+ * This source code is licensed under the BSD-style license found in the
+ * LICENSE file in the root directory of this source tree. An additional grant
+ * of patent rights can be found in the PATENTS file in the same directory.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+var (
+	probeTestSrc = net.ParseIP("10.0.0.2")
+	probeTestDst = net.ParseIP("10.9.9.9")
+)
+
+// the probe encodings: how a probe goes out, and how it is recovered from the packet quoted or echoed back
+var probeFamilies = []struct {
+	name   string
+	encode func(probe Probe) []byte
+	decode func(packet []byte) (Probe, bool)
+	// where the check byte, or the hidden tag, sits in the packet
+	check int
+}{
+	{"tcp", func(probe Probe) []byte {
+		return makeTCPHeader("ip4", &probeTestSrc, &probeTestDst, probe.srcPort, 80, probeSeqNum(probe))
+	}, func(packet []byte) (Probe, bool) {
+		tcpHdr := parseTCPHeader(packet)
+		return parseProbeSeqNum(int(tcpHdr.Source), tcpHdr.SeqNum)
+	}, 5},
+	{"udp", func(probe Probe) []byte {
+		return makeUDPPacket("ip4", &probeTestSrc, &probeTestDst, probe.srcPort, 33434, probe.ttl, udpProbeChecksum(probe))
+	}, func(packet []byte) (Probe, bool) {
+		// the tag has no check byte, a probe of another run comes out with some other tag
+		udpHdr := parseUDPHeader(packet)
+		ttl := udpHdr.probeTTL()
+		probe := Probe{srcPort: int(udpHdr.Source), ttl: ttl, tag: udpProbeTag(int(udpHdr.Source), ttl, udpHdr.Checksum)}
+		return probe, ownTag(probe.tag)
+	}, 6},
+	{"udp payload", func(probe Probe) []byte {
+		return makeUDPPayload(probe)
+	}, func(packet []byte) (Probe, bool) {
+		return parseUDPPayload(33000, packet)
+	}, 3},
+	{"icmp quoted", func(probe Probe) []byte {
+		return makeICMPEchoPacket("ip4", &probeTestSrc, &probeTestDst, probe)
+	}, func(packet []byte) (Probe, bool) {
+		echo := parseICMPEchoHeader(packet)
+		return echo.probe(int(echo.Checksum))
+	}, 6},
+	{"icmp echoed", func(probe Probe) []byte {
+		return makeICMPEchoPacket("ip4", &probeTestSrc, &probeTestDst, probe)
+	}, func(packet []byte) (Probe, bool) {
+		// the flow id is echoed back in the payload, after the 8 bytes of header
+		echo := parseICMPEchoHeader(packet)
+		return echo.probe(int(binary.BigEndian.Uint16(packet[8:])))
+	}, 6},
+}
+
+// Run f as the run with the given instance id and secret
+func asProbeInstance(instance, secret uint32, f func()) {
+	savedInstance, savedSecret := probeInstance, probeSecret
+	defer func() { probeInstance, probeSecret = savedInstance, savedSecret }()
+	probeInstance, probeSecret = instance, secret
+	f()
+}
+
+func TestProbeEncoding(t *testing.T) {
+	tests := []struct {
+		name string
+		// the instance id and the secret of the run sending the probe
+		instance, secret uint32
+		iteration        int
+		corrupt          bool
+		accepted         bool
+	}{
+		{"own probe", 5, 0x1234, 1, false, true},
+		{"own probe, later iteration", 5, 0x1234, 700, false, true},
+		{"iteration wrapping around", 5, 0x1234, int(probeIterationMask) + 3, false, true},
+		{"another instance", 6, 0x5678, 1, false, false},
+		{"same instance id, another secret", 5, 0x5678, 1, false, false},
+		{"bad check byte", 5, 0x1234, 1, true, false},
+	}
+
+	for _, family := range probeFamilies {
+		for _, test := range tests {
+			var sent Probe
+			var packet []byte
+			asProbeInstance(test.instance, test.secret, func() {
+				sent = Probe{srcPort: 33000, ttl: 7, tag: probeTag(test.iteration)}
+				packet = family.encode(sent)
+			})
+			if test.corrupt {
+				packet[family.check] ^= 0x5a
+			}
+
+			var got Probe
+			var own bool
+			asProbeInstance(5, 0x1234, func() {
+				got, own = family.decode(packet)
+			})
+			if accepted := own && got == sent; accepted != test.accepted {
+				t.Errorf("%s, %s: got %+v own %v, want accepted %v for %+v", family.name, test.name, got, own, test.accepted, sent)
+			}
+		}
+	}
+}
+
+func TestUDPProbeZeroChecksum(t *testing.T) {
+	asProbeInstance(5, 0x1234, func() {
+		// find a probe whose hidden tag comes out as zero, sent as all ones instead
+		for srcPort := 33000; srcPort < 34000; srcPort++ {
+			tag := uint32(probeTagKey(srcPort, 7))
+			if !ownTag(tag) {
+				continue
+			}
+			sent := Probe{srcPort: srcPort, ttl: 7, tag: tag}
+			if checksum := udpProbeChecksum(sent); checksum != 0 {
+				t.Fatalf("source port %d: got checksum %#x, want 0", srcPort, checksum)
+			}
+			udpHdr := parseUDPHeader(makeUDPPacket("ip4", &probeTestSrc, &probeTestDst, srcPort, 33434, 7, udpProbeChecksum(sent)))
+			if udpHdr.Checksum != 0xffff {
+				t.Errorf("source port %d: got checksum %#x on the wire, want 0xffff", srcPort, udpHdr.Checksum)
+			}
+			if got := udpProbeTag(srcPort, udpHdr.probeTTL(), udpHdr.Checksum); got != tag {
+				t.Errorf("source port %d: got tag %#x, want %#x", srcPort, got, tag)
+			}
+			return
+		}
+		t.Fatalf("no probe with a zero checksum found")
+	})
+}
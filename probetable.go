@@ -0,0 +1,257 @@
+/**
+ * Copyright (c) 2016-present, Facebook, Inc.
+ * All rights reserved.
+ *
+ * This source code is licensed under the BSD-style license found in the
+ * LICENSE file in the root directory of this source tree. An additional grant
+ * of patent rights can be found in the PATENTS file in the same directory.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// all probe tags fit in the 16 bits we have in the UDP checksum/ICMP identifier
+const probeTagMask uint32 = 0xffff
+
+// the top bits of every probe tag carry the instance id of the run, the rest count the iterations,
+// so that concurrent runs towards the same target do not take each other's responses
+const (
+	probeInstanceBits         = 6
+	probeIterationBits        = 16 - probeInstanceBits
+	probeIterationMask uint32 = 1<<probeIterationBits - 1
+)
+
+// the instance id of this run, and the secret behind the check bytes of its probes
+var probeInstance, probeSecret uint32
+
+func init() {
+	r := rand.New(rand.NewSource(time.Now().UnixNano() ^ int64(os.Getpid())<<32))
+	probeInstance = uint32(r.Intn(1 << probeInstanceBits))
+	probeSecret = r.Uint32()
+}
+
+// answered and expired probes are kept around this many timeouts to catch late responses
+const probeRetention = 10
+
+// reference point of our monotonic clock
+var monoStart = time.Now()
+
+// Monotonic clock reading in nanoseconds, immune to wall clock adjustments
+func monotime() int64 {
+	return int64(time.Since(monoStart))
+}
+
+// Find the tag of the probe sent in the given iteration over the source port range; tags
+// are never zero, since zero UDP checksum has a special meaning
+func probeTag(iteration int) uint32 {
+	return probeInstance<<probeIterationBits | (uint32(iteration)%probeIterationMask + 1)
+}
+
+// Tell if the tag was issued by this run
+func ownTag(tag uint32) bool {
+	return tag&probeTagMask>>probeIterationBits == probeInstance && tag&probeIterationMask != 0
+}
+
+// Hash the flow, ttl and tag of a probe with the secret of this run
+func probeHash(srcPort, ttl int, tag uint32) uint32 {
+	var buf [16]byte
+	binary.BigEndian.PutUint32(buf[0:], probeSecret)
+	binary.BigEndian.PutUint32(buf[4:], uint32(srcPort))
+	binary.BigEndian.PutUint32(buf[8:], uint32(ttl))
+	binary.BigEndian.PutUint32(buf[12:], tag&probeTagMask)
+
+	h := fnv.New32a()
+	h.Write(buf[:])
+	return h.Sum32()
+}
+
+// Find the check byte of the probe, a keyed hash of its flow, ttl and tag, sent along
+// with the probe where the encoding has room for it. Nobody but this run can forge it
+func probeCheck(probe Probe) uint32 {
+	return probeHash(probe.srcPort, probe.ttl, probe.tag) & 0xff
+}
+
+// Find the key hiding the tag of a probe sent where the encoding has no room for a check byte: a keyed
+// hash of its flow and ttl. Recovered with it, the tag of a probe sent by anyone else comes out random, so it
+// carries the instance id of this run and matches one of the outstanding probes by chance only
+func probeTagKey(srcPort, ttl int) uint16 {
+	return uint16(probeHash(srcPort, ttl, 0) >> 16)
+}
+
+// probeKey identifies a single probe: the flow, the ttl and the tag encoded in the packet
+type probeKey struct {
+	srcPort int
+	ttl     int
+	tag     uint32
+}
+
+// state of a probe in the table
+type probeState int
+
+const (
+	probeOutstanding probeState = iota
+	probeAnswered
+	probeExpired
+)
+
+// matchStatus tells how a response relates to the probes in the table
+type matchStatus int
+
+const (
+	// the first response to a probe, within its deadline
+	matchOK matchStatus = iota
+	// the probe has already been answered
+	matchDuplicate
+	// the response came in after the probe deadline
+	matchLate
+	// we have no record of sending such probe
+	matchUnknown
+)
+
+type probeEntry struct {
+	sent  int64 /* ns */
+	state probeState
+}
+
+// ProbeTable keeps track of every probe we sent, until it is answered or its deadline passes
+type ProbeTable struct {
+	sync.Mutex
+	timeout     time.Duration
+	entries     map[probeKey]*probeEntry
+	outstanding int
+
+	// counters for the final report
+	counts probeCounts
+}
+
+// probeCounts tells how the probes in the table fared, and how many responses did not match any of them
+type probeCounts struct {
+	answered   int
+	timedOut   int
+	duplicates int
+	late       int
+	unknown    int
+}
+
+func newProbeTable(timeout time.Duration) *ProbeTable {
+	return &ProbeTable{
+		timeout: timeout,
+		entries: make(map[probeKey]*probeEntry),
+	}
+}
+
+// Record the probe as sent just now
+func (t *ProbeTable) add(probe Probe) {
+	t.Lock()
+	defer t.Unlock()
+
+	key := probeKey{srcPort: probe.srcPort, ttl: probe.ttl, tag: probe.tag & probeTagMask}
+	if entry, ok := t.entries[key]; ok && entry.state == probeOutstanding {
+		t.outstanding--
+	}
+	t.entries[key] = &probeEntry{sent: monotime(), state: probeOutstanding}
+	t.outstanding++
+}
+
+// Match a response received at the given monotonic time against the table, and find the probe RTT
+func (t *ProbeTable) match(probe Probe, received int64) (time.Duration, matchStatus) {
+	t.Lock()
+	defer t.Unlock()
+
+	key := probeKey{srcPort: probe.srcPort, ttl: probe.ttl, tag: probe.tag & probeTagMask}
+	entry, ok := t.entries[key]
+	if !ok {
+		t.counts.unknown++
+		return 0, matchUnknown
+	}
+
+	rtt := time.Duration(received - entry.sent)
+
+	switch {
+	case entry.state == probeAnswered:
+		t.counts.duplicates++
+		return rtt, matchDuplicate
+	case entry.state == probeExpired || rtt > t.timeout:
+		if entry.state == probeOutstanding {
+			t.outstanding--
+			t.counts.timedOut++
+			entry.state = probeExpired
+		}
+		t.counts.late++
+		return rtt, matchLate
+	}
+
+	entry.state = probeAnswered
+	t.outstanding--
+	t.counts.answered++
+
+	return rtt, matchOK
+}
+
+// Expire the probes past their deadline and forget about the old ones
+func (t *ProbeTable) expire() {
+	t.Lock()
+	defer t.Unlock()
+
+	now := monotime()
+	for key, entry := range t.entries {
+		age := time.Duration(now - entry.sent)
+		if entry.state == probeOutstanding && age > t.timeout {
+			entry.state = probeExpired
+			t.outstanding--
+			t.counts.timedOut++
+		}
+		if age > probeRetention*t.timeout {
+			delete(t.entries, key)
+		}
+	}
+}
+
+// Periodically expire probes until told to stop
+func (t *ProbeTable) run(done <-chan struct{}) {
+	ticker := time.NewTicker(t.timeout / 10)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.expire()
+		case <-done:
+			return
+		}
+	}
+}
+
+// Take a snapshot of the counters, the table may still be expiring probes
+func (t *ProbeTable) stats() probeCounts {
+	t.Lock()
+	defer t.Unlock()
+	return t.counts
+}
+
+// Block until every probe has been either answered or expired
+func (t *ProbeTable) drain() {
+	for {
+		t.expire()
+
+		t.Lock()
+		outstanding := t.outstanding
+		t.Unlock()
+
+		if outstanding == 0 {
+			return
+		}
+		glog.V(2).Infof("Waiting for %d outstanding probes\n", outstanding)
+		time.Sleep(t.timeout / 10)
+	}
+}
@@ -0,0 +1,163 @@
+/**
+ * Copyright (c) 2016-present, Facebook, Inc.
+ * All rights reserved.
+ *
+ * This source code is licensed under the BSD-style license found in the
+ * LICENSE file in the root directory of this source tree. An additional grant
+ * of patent rights can be found in the PATENTS file in the same directory.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+const (
+	// we need this many whole seconds of probing to tell a policer from random loss
+	minRateLimitSeconds = 3
+	// ... and this many probes offered to the responder per second
+	minRateLimitOffered = 20
+	// responders answering more than this fraction of the probes are not limited
+	maxRateLimitHitRate = 0.95
+	// the variance of the per-second responses, relative to what random loss would give,
+	// below which the responses are considered capped
+	maxRateLimitDispersion = 0.3
+)
+
+// rateBins counts events per second of monotonic time
+type rateBins map[int64] /* second */ int
+
+// Count an event at the given monotonic time
+func (b rateBins) add(t int64) {
+	b[t/int64(time.Second)]++
+}
+
+// Add up the counts of the other bins
+func (b rateBins) merge(other rateBins) {
+	for s, n := range other {
+		b[s] += n
+	}
+}
+
+// RateLimit describes a responder whose ICMP responses are capped by a control plane policer
+type RateLimit struct {
+	Responder string
+	// the steady response rate, per second
+	Ceiling float64
+	// the responses over the ceiling in the first second of probing, the token bucket depth
+	Burst int
+	// the fraction of the probes sent to the responder it answered
+	HitRate float64
+	// the variance of the per-second responses relative to random loss, close to 0 for a policer
+	Dispersion float64
+}
+
+//
+// Find the responders that answer at a constant rate regardless of the number of probes we throw at
+// them. With random loss, the number of responses per second follows the binomial distribution (and
+// the probe volume), while a policer hands out the same number of tokens every second, so the
+// responses show a lot less variance than the loss rate would give. A token bucket policer also lets
+// a burst through before settling on its rate
+//
+func findRateLimits(offered, answered map[string] /* responder */ rateBins) map[string] /* responder */ *RateLimit {
+	limits := make(map[string]*RateLimit)
+
+	for responder, offeredBins := range offered {
+		answeredBins := answered[responder]
+
+		var seconds []int64
+		for s := range offeredBins {
+			seconds = append(seconds, s)
+		}
+		sort.Sort(seconds64(seconds))
+
+		// the first and the last seconds are partial, leave them out of the steady state
+		if len(seconds) < minRateLimitSeconds+2 {
+			continue
+		}
+		steady := seconds[1 : len(seconds)-1]
+
+		var sumOffered, sumAnswered float64
+		for _, s := range steady {
+			sumOffered += float64(offeredBins[s])
+			sumAnswered += float64(answeredBins[s])
+		}
+		n := float64(len(steady))
+		if sumOffered/n < minRateLimitOffered {
+			continue
+		}
+		hitRate := sumAnswered / sumOffered
+		if hitRate > maxRateLimitHitRate || hitRate == 0 {
+			continue
+		}
+
+		// variance of the responses against the binomial variance of random loss
+		ceiling := sumAnswered / n
+		var variance, binomial float64
+		for _, s := range steady {
+			d := float64(answeredBins[s]) - ceiling
+			variance += d * d
+			binomial += float64(offeredBins[s]) * hitRate * (1 - hitRate)
+		}
+		variance /= n - 1
+		binomial /= n
+		dispersion := variance / binomial
+		if dispersion > maxRateLimitDispersion {
+			continue
+		}
+
+		// what the ceiling would let through over the first, partial, second
+		first := seconds[0]
+		expected := ceiling * float64(offeredBins[first]) / (sumOffered / n)
+		burst := int(float64(answeredBins[first]) - math.Min(expected, float64(offeredBins[first])))
+		if burst < 0 {
+			burst = 0
+		}
+
+		limits[responder] = &RateLimit{
+			Responder:  responder,
+			Ceiling:    ceiling,
+			Burst:      burst,
+			HitRate:    hitRate,
+			Dispersion: dispersion,
+		}
+	}
+
+	return limits
+}
+
+// seconds64 implements sort.Interface for the bin keys
+type seconds64 []int64
+
+func (s seconds64) Len() int           { return len(s) }
+func (s seconds64) Less(i, j int) bool { return s[i] < s[j] }
+func (s seconds64) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+//
+// print the responders found to rate limit their ICMP responses
+//
+func printRateLimits(limits map[string] /* responder */ *RateLimit) {
+	var responders []string
+	for responder := range limits {
+		responders = append(responders, responder)
+	}
+	sort.Strings(responders)
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"responder", "ceiling pps", "burst", "hit rate", "dispersion"})
+	for _, responder := range responders {
+		l := limits[responder]
+		table.Append([]string{responder, fmt.Sprintf("%.1f", l.Ceiling), fmt.Sprintf("%d", l.Burst), fmt.Sprintf("%.0f%%", 100*l.HitRate), fmt.Sprintf("%.2f", l.Dispersion)})
+	}
+
+	fmt.Fprintf(os.Stdout, "Rate-limited hops:\n")
+	table.Render()
+	fmt.Fprintf(os.Stdout, "\n")
+}
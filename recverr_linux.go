@@ -0,0 +1,319 @@
+/**
+ * Copyright (c) 2016-present, Facebook, Inc.
+ * All rights reserved.
+ *
+ * This source code is licensed under the BSD-style license found in the
+ * LICENSE file in the root directory of this source tree. An additional grant
+ * of patent rights can be found in the PATENTS file in the same directory.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/golang/glog"
+)
+
+//
+// Origin of the errors queued with IP_RECVERR/IPV6_RECVERR, see linux/errqueue.h
+//
+const (
+	soEEOriginICMP  = 2
+	soEEOriginICMP6 = 3
+)
+
+// size of struct sock_extended_err, the offender address follows it
+const sockExtendedErrSize int = 16
+
+// udpSocketPool holds one connected UDP socket per source port
+type udpSocketPool struct {
+	sync.Mutex
+	af      string
+	dstAddr net.IP
+	sockets map[int] /* src port */ int /* fd */
+	ports   map[int] /* fd */ int       /* src port */
+}
+
+//
+// Open, bind and connect one UDP socket per source port, asking the kernel to queue
+// the ICMP errors it receives for them
+//
+func newUDPSocketPool(af string, srcAddr, dstAddr *net.IP, dstPort, baseSrcPort, maxSrcPorts, tos int) (*udpSocketPool, error) {
+	pool := &udpSocketPool{
+		af:      af,
+		dstAddr: *dstAddr,
+		sockets: make(map[int]int),
+		ports:   make(map[int]int),
+	}
+
+	for srcPort := baseSrcPort; srcPort < baseSrcPort+maxSrcPorts; srcPort++ {
+		var fd int
+		var err error
+
+		switch {
+		case af == "ip4":
+			fd, err = syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+		case af == "ip6":
+			fd, err = syscall.Socket(syscall.AF_INET6, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+		default:
+			err = fmt.Errorf("Unknown address family supplied")
+		}
+
+		if err != nil {
+			pool.close()
+			return nil, err
+		}
+
+		pool.sockets[srcPort] = fd
+		pool.ports[fd] = srcPort
+
+		switch {
+		case af == "ip4":
+			var src, dst [4]byte
+			copy(src[:], srcAddr.To4())
+			copy(dst[:], dstAddr.To4())
+			if err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_RECVERR, 1); err != nil {
+				break
+			}
+			if err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, tos); err != nil {
+				break
+			}
+			if err = syscall.Bind(fd, &syscall.SockaddrInet4{Port: srcPort, Addr: src}); err != nil {
+				break
+			}
+			err = syscall.Connect(fd, &syscall.SockaddrInet4{Port: dstPort, Addr: dst})
+		case af == "ip6":
+			var src, dst [16]byte
+			copy(src[:], srcAddr.To16())
+			copy(dst[:], dstAddr.To16())
+			if err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_RECVERR, 1); err != nil {
+				break
+			}
+			if err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos); err != nil {
+				break
+			}
+			if err = syscall.Bind(fd, &syscall.SockaddrInet6{Port: srcPort, Addr: src}); err != nil {
+				break
+			}
+			err = syscall.Connect(fd, &syscall.SockaddrInet6{Port: dstPort, Addr: dst})
+		}
+
+		if err != nil {
+			pool.close()
+			return nil, fmt.Errorf("Could not set up UDP socket for source port %d: %s", srcPort, err)
+		}
+	}
+
+	return pool, nil
+}
+
+//
+// Send the payload from the given source port with the given ttl; the pool is shared by
+// the senders of all ttls, hence the ttl change and the write must happen atomically
+//
+func (pool *udpSocketPool) send(srcPort, ttl int, payload []byte) error {
+	pool.Lock()
+	defer pool.Unlock()
+
+	fd, ok := pool.sockets[srcPort]
+	if !ok {
+		return fmt.Errorf("No socket for source port %d", srcPort)
+	}
+
+	var err error
+	switch {
+	case pool.af == "ip4":
+		err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+	case pool.af == "ip6":
+		err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	_, err = syscall.Write(fd, payload)
+	switch err {
+	// a pending ICMP error is reported (and cleared) by the next write, just try again
+	case syscall.ECONNREFUSED, syscall.EHOSTUNREACH, syscall.ENETUNREACH, syscall.EPROTO, syscall.EACCES, syscall.EMSGSIZE,
+		syscall.ENOPROTOOPT, syscall.EOPNOTSUPP, syscall.EHOSTDOWN, syscall.ENONET:
+		_, err = syscall.Write(fd, payload)
+	}
+
+	return err
+}
+
+// Close all sockets of the pool
+func (pool *udpSocketPool) close() {
+	pool.Lock()
+	defer pool.Unlock()
+
+	for fd := range pool.ports {
+		syscall.Close(fd)
+	}
+	pool.sockets = make(map[int]int)
+	pool.ports = make(map[int]int)
+}
+
+// ErrQueueReceiver collects the ICMP errors the kernel queued on the sockets of the pool,
+// until its explicitly told to stop. It emits UDPResponse for port unreachable errors sent by the
+// target and ICMPResponse for every other error, just like ICMPReceiver does for raw sockets
+func ErrQueueReceiver(done <-chan struct{}, af string, pool *udpSocketPool, maxTTL int) (chan interface{}, error) {
+	var errLevel, errType int
+	var unreachType, portUnreachCode uint8
+	var icmpOrigin uint8
+
+	switch {
+	case af == "ip4":
+		errLevel, errType = syscall.IPPROTO_IP, syscall.IP_RECVERR
+		unreachType, portUnreachCode = 3, 3
+		icmpOrigin = soEEOriginICMP
+	case af == "ip6":
+		errLevel, errType = syscall.IPPROTO_IPV6, syscall.IPV6_RECVERR
+		unreachType, portUnreachCode = 1, 4
+		icmpOrigin = soEEOriginICMP6
+	default:
+		return nil, fmt.Errorf("Unknown address family supplied")
+	}
+
+	epfd, err := syscall.EpollCreate1(0)
+	if err != nil {
+		return nil, err
+	}
+
+	// error conditions are always reported by epoll, no need to ask for more
+	pool.Lock()
+	for fd := range pool.ports {
+		event := syscall.EpollEvent{Events: syscall.EPOLLERR, Fd: int32(fd)}
+		if err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, &event); err != nil {
+			break
+		}
+	}
+	pool.Unlock()
+
+	if err != nil {
+		syscall.Close(epfd)
+		return nil, err
+	}
+
+	glog.V(2).Infoln("ErrQueueReceiver is starting...")
+
+	out := make(chan interface{})
+
+	go func() {
+		defer pool.close()
+		defer syscall.Close(epfd)
+		defer close(out)
+
+		events := make([]syscall.EpollEvent, 64)
+		payload := make([]byte, 64)
+		oob := make([]byte, 512)
+
+		for {
+			select {
+			case <-done:
+				glog.V(2).Infoln("ErrQueueReceiver done")
+				return
+			default:
+			}
+
+			n, err := syscall.EpollWait(epfd, events, 100)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil {
+				glog.Errorf("Error waiting for socket errors %s\n", err)
+				return
+			}
+
+			for _, event := range events[:n] {
+				fd := int(event.Fd)
+
+				pool.Lock()
+				srcPort := pool.ports[fd]
+				pool.Unlock()
+
+				// drain the error queue of the socket
+				for {
+					pn, oobn, _, _, err := syscall.Recvmsg(fd, payload, oob, syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT)
+					if err != nil {
+						break
+					}
+					received := monotime()
+					if pn < udpPayloadSize {
+						continue
+					}
+
+					msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+					if err != nil {
+						continue
+					}
+
+					for _, msg := range msgs {
+						if int(msg.Header.Level) != errLevel || int(msg.Header.Type) != errType || len(msg.Data) < sockExtendedErrSize {
+							continue
+						}
+
+						// struct sock_extended_err, see linux/errqueue.h
+						origin, icmpType, icmpCode := msg.Data[4], msg.Data[5], msg.Data[6]
+						if origin != icmpOrigin {
+							continue
+						}
+
+						probe, own := parseUDPPayload(srcPort, payload[:pn])
+						if !own || probe.ttl < 1 || probe.ttl > maxTTL {
+							continue
+						}
+
+						icmpErr := newICMPError(af, int(icmpType), int(icmpCode))
+						fromAddr := offenderAddr(af, msg.Data[sockExtendedErrSize:])
+						switch {
+						case icmpErr == nil || fromAddr == nil:
+							continue
+						case icmpType == unreachType && icmpCode == portUnreachCode && fromAddr.Equal(pool.dstAddr):
+							out <- UDPResponse{Probe: probe, received: received}
+						case icmpErr.Outcome == outcomeNotice:
+							glog.V(2).Infof("Received %s from %s for source port %d ttl %d\n", icmpErr, fromAddr, probe.srcPort, probe.ttl)
+						default:
+							out <- ICMPResponse{Probe: probe, fromAddr: &fromAddr, icmpError: icmpErr, received: received}
+						}
+					}
+				}
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+//
+// Extract the address of the node that sent us the ICMP error, it follows
+// the sock_extended_err structure as sockaddr_in or sockaddr_in6
+//
+func offenderAddr(af string, data []byte) net.IP {
+	const (
+		sockaddrInAddrOffset  = 4
+		sockaddrIn6AddrOffset = 8
+	)
+
+	if len(data) < 2 {
+		return nil
+	}
+
+	// the family is in the host byte order
+	family := *(*uint16)(unsafe.Pointer(&data[0]))
+
+	switch {
+	case af == "ip4" && family == syscall.AF_INET && len(data) >= sockaddrInAddrOffset+net.IPv4len:
+		return net.IP(append([]byte(nil), data[sockaddrInAddrOffset:sockaddrInAddrOffset+net.IPv4len]...))
+	case af == "ip6" && family == syscall.AF_INET6 && len(data) >= sockaddrIn6AddrOffset+net.IPv6len:
+		return net.IP(append([]byte(nil), data[sockaddrIn6AddrOffset:sockaddrIn6AddrOffset+net.IPv6len]...))
+	}
+
+	return nil
+}
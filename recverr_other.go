@@ -0,0 +1,36 @@
+//go:build !linux
+// +build !linux
+
+/**
+ * Copyright (c) 2016-present, Facebook, Inc.
+ * All rights reserved.
+ *
+ * This source code is licensed under the BSD-style license found in the
+ * LICENSE file in the root directory of this source tree. An additional grant
+ * of patent rights can be found in the PATENTS file in the same directory.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// udpSocketPool is only available on Linux, which has IP_RECVERR
+type udpSocketPool struct{}
+
+func newUDPSocketPool(af string, srcAddr, dstAddr *net.IP, dstPort, baseSrcPort, maxSrcPorts, tos int) (*udpSocketPool, error) {
+	return nil, fmt.Errorf("Unprivileged mode is only supported on Linux")
+}
+
+func (pool *udpSocketPool) send(srcPort, ttl int, payload []byte) error {
+	return fmt.Errorf("Unprivileged mode is only supported on Linux")
+}
+
+func (pool *udpSocketPool) close() {}
+
+// ErrQueueReceiver is only available on Linux, which has IP_RECVERR
+func ErrQueueReceiver(done <-chan struct{}, af string, pool *udpSocketPool, maxTTL int) (chan interface{}, error) {
+	return nil, fmt.Errorf("Unprivileged mode is only supported on Linux")
+}
@@ -0,0 +1,85 @@
+/**
+ * Copyright (c) 2016-present, Facebook, Inc.
+ * All rights reserved.
+ *
+ * This source code is licensed under the BSD-style license found in the
+ * LICENSE file in the root directory of this source tree. An additional grant
+ * of patent rights can be found in the PATENTS file in the same directory.
+ */
+
+package main
+
+// senderFunc starts a sender for the given ttl, looping over the given source ports for the given number of iterations
+type senderFunc func(done <-chan struct{}, ttl int, srcPorts []int, iters int) (chan interface{}, error)
+
+// hopResponse tells who answered a probe sent in a probe round
+type hopResponse struct {
+	addr string
+	// the probe made it all the way to the target
+	target bool
+}
+
+//
+// Send a round of probes with the given ttl over the given source ports, and wait until every one of them
+// is either answered or expired. Unlike the regular tracing, this is synchronous: the responses are taken
+// off the given channel and matched against the table right here, so nothing else may be probing meanwhile.
+// Returns the responses per source port, in the order of arrival, and the number of probes sent
+//
+func probeRound(table *ProbeTable, in <-chan interface{}, start senderFunc, ttl int, srcPorts []int, iters int) (map[int] /* src port */ []hopResponse, int, error) {
+	responses := make(map[int][]hopResponse)
+	sent := 0
+
+	senderDone := make(chan struct{})
+	defer close(senderDone)
+
+	probes, err := start(senderDone, ttl, srcPorts, iters)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// count the probes, and wait for the last of them to get answered or expire
+	done := make(chan struct{})
+	go func() {
+		for range probes {
+			sent++
+		}
+		table.drain()
+		close(done)
+	}()
+
+	for {
+		var probe Probe
+		var received int64
+		var resp hopResponse
+
+		select {
+		case val := <-in:
+			switch val.(type) {
+			case ICMPResponse:
+				icmpResp := val.(ICMPResponse)
+				probe, received = icmpResp.Probe, icmpResp.received
+				resp = hopResponse{addr: icmpResp.fromAddr.String()}
+			case TCPResponse:
+				probe, received = val.(TCPResponse).Probe, val.(TCPResponse).received
+				resp.target = true
+			case UDPResponse:
+				probe, received = val.(UDPResponse).Probe, val.(UDPResponse).received
+				resp.target = true
+			case EchoResponse:
+				probe, received = val.(EchoResponse).Probe, val.(EchoResponse).received
+				resp.target = true
+			default:
+				continue
+			}
+		case <-done:
+			return responses, sent, nil
+		}
+
+		if probe.ttl != ttl {
+			continue
+		}
+		if _, status := table.match(probe, received); status == matchOK {
+			responses[probe.srcPort] = append(responses[probe.srcPort], resp)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+/**
+ * Copyright (c) 2016-present, Facebook, Inc.
+ * All rights reserved.
+ *
+ * This source code is licensed under the BSD-style license found in the
+ * LICENSE file in the root directory of this source tree. An additional grant
+ * of patent rights can be found in the PATENTS file in the same directory.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// the hop name shown in the reports for the hops that never answered
+const nonResponding = "non-responding"
+
+// SilentHop summarizes a ttl where some of the paths went through a router that never answered
+type SilentHop struct {
+	TTL int
+	// how many paths were silent at this ttl, out of the paths that go past it
+	Ports int
+	Paths int
+}
+
+//
+// Find the hops that did not answer a single probe, while some hop further along the same path did.
+// Routers that never send time-exceeded look exactly like 100% loss, and would either hide the
+// real loss downstream or get the wrong segment blamed, so these are kept out of the loss computation
+//
+func findSilentHops(sent, rcvd map[int] /* src port */ []int) map[int] /* src port */ []bool {
+	silent := make(map[int][]bool)
+
+	for srcPort, rcvdVector := range rcvd {
+		sentVector := sent[srcPort]
+		answered := false
+		for i := len(rcvdVector) - 1; i >= 0; i-- {
+			if rcvdVector[i] > 0 {
+				answered = true
+				continue
+			}
+			if answered && i < len(sentVector) && sentVector[i] > 0 {
+				if silent[srcPort] == nil {
+					silent[srcPort] = make([]bool, len(rcvdVector))
+				}
+				silent[srcPort][i] = true
+			}
+		}
+	}
+
+	return silent
+}
+
+// Summarize the silent hops across all paths, per ttl
+func summarizeSilentHops(sent map[int] /* src port */ []int, silent map[int] /* src port */ []bool) []SilentHop {
+	summary := make(map[int]*SilentHop)
+
+	for _, silentVector := range silent {
+		for i, s := range silentVector {
+			if !s {
+				continue
+			}
+			if summary[i+1] == nil {
+				summary[i+1] = &SilentHop{TTL: i + 1}
+			}
+			summary[i+1].Ports++
+		}
+	}
+
+	var result []SilentHop
+	for ttl, hop := range summary {
+		for _, sentVector := range sent {
+			if len(sentVector) > ttl {
+				hop.Paths++
+			}
+		}
+		result = append(result, *hop)
+	}
+	sort.Sort(silentHopsByTTL(result))
+
+	return result
+}
+
+type silentHopsByTTL []SilentHop
+
+func (s silentHopsByTTL) Len() int           { return len(s) }
+func (s silentHopsByTTL) Less(i, j int) bool { return s[i].TTL < s[j].TTL }
+func (s silentHopsByTTL) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+//
+// print the ttls where paths went through non-responding hops
+//
+func printSilentHops(summary []SilentHop) {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"TTL", "non-responding paths"})
+	for _, hop := range summary {
+		table.Append([]string{fmt.Sprintf("%d", hop.TTL), fmt.Sprintf("%d/%d", hop.Ports, hop.Paths)})
+	}
+
+	fmt.Fprintf(os.Stdout, "Non-responding hops:\n")
+	table.Render()
+	fmt.Fprintf(os.Stdout, "\n")
+}
@@ -0,0 +1,95 @@
+/**
+ * Copyright (c) 2016-present, Facebook, Inc.
+ * All rights reserved.
+ *
+ * This source code is licensed under the BSD-style license found in the
+ * LICENSE file in the root directory of this source tree. An additional grant
+ * of patent rights can be found in the PATENTS file in the same directory.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// RTTStats summarizes the RTT samples collected for one source port/hop, durations are in nanoseconds
+type RTTStats struct {
+	Samples int
+	Min     time.Duration
+	Avg     time.Duration
+	P50     time.Duration
+	P95     time.Duration
+	Max     time.Duration
+	// mean absolute difference between consecutive samples, as in RFC 3550
+	Jitter time.Duration
+}
+
+//
+// Compute the RTT statistics over the samples, which are expected in the order of arrival
+//
+func computeRTTStats(samples []time.Duration) RTTStats {
+	var stats RTTStats
+
+	stats.Samples = len(samples)
+	if stats.Samples == 0 {
+		return stats
+	}
+
+	var sum, jitter time.Duration
+	for i, rtt := range samples {
+		sum += rtt
+		if i > 0 {
+			diff := rtt - samples[i-1]
+			if diff < 0 {
+				diff = -diff
+			}
+			jitter += diff
+		}
+	}
+	stats.Avg = sum / time.Duration(len(samples))
+	if len(samples) > 1 {
+		stats.Jitter = jitter / time.Duration(len(samples)-1)
+	}
+
+	sorted := make([]time.Duration, len(samples))
+	copy(sorted, samples)
+	sort.Sort(durations(sorted))
+
+	stats.Min = sorted[0]
+	stats.Max = sorted[len(sorted)-1]
+	stats.P50 = percentile(sorted, 50)
+	stats.P95 = percentile(sorted, 95)
+
+	return stats
+}
+
+// Nearest-rank percentile of the sorted samples
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// Format the statistics for the report tables: min/avg/p50/p95/max and jitter, in milliseconds
+func (stats RTTStats) String() string {
+	if stats.Samples == 0 {
+		return "-"
+	}
+	ms := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+	return fmt.Sprintf("%.2f/%.2f/%.2f/%.2f/%.2f ±%.2f", ms(stats.Min), ms(stats.Avg), ms(stats.P50), ms(stats.P95), ms(stats.Max), ms(stats.Jitter))
+}
+
+// durations sorts the RTT samples. Like every sortable type in this package, it implements sort.Interface
+// rather than relying on sort.Slice, so that the tool still builds with the Go releases predating it
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
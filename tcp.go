@@ -13,6 +13,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"net"
+	"syscall"
 )
 
 //
@@ -65,6 +66,17 @@ func makeTCPHeader(af string, srcAddr, dstAddr *net.IP, srcPort, dstPort int, ts
 	return TCPHeader.Serialize()
 }
 
+// Encode the probe into the ISN of its SYN: the ttl in the top byte, then the check byte, then the tag
+func probeSeqNum(probe Probe) uint32 {
+	return uint32(probe.ttl&0xff)<<24 | probeCheck(probe)<<16 | probe.tag&probeTagMask
+}
+
+// Recover the probe sent from the given source port with the ISN, and tell if this run has sent it
+func parseProbeSeqNum(srcPort int, seqNum uint32) (Probe, bool) {
+	probe := Probe{srcPort: srcPort, ttl: int(seqNum >> 24), tag: seqNum & probeTagMask}
+	return probe, ownTag(probe.tag) && seqNum>>16&0xff == probeCheck(probe)
+}
+
 // Parse packet into TCPHeader structure
 func parseTCPHeader(data []byte) *TCPHeader {
 	var tcp TCPHeader
@@ -122,47 +134,5 @@ func (tcp *TCPHeader) Serialize() []byte {
 // TCP Checksum, works for both v4 and v6 IP addresses
 //
 func tcpChecksum(af string, data []byte, srcip, dstip *net.IP) uint16 {
-
-	// the pseudo header used for TCP c-sum computation
-	var pseudoHeader []byte
-
-	pseudoHeader = append(pseudoHeader, *srcip...)
-	pseudoHeader = append(pseudoHeader, *dstip...)
-	switch {
-	case af == "ip4":
-		pseudoHeader = append(pseudoHeader, []byte{
-			0,
-			6,                  // protocol number for TCP
-			0, byte(len(data)), // TCP length (16 bits), w/o pseudoheader
-		}...)
-	case af == "ip6":
-		pseudoHeader = append(pseudoHeader, []byte{
-			0, 0, 0, byte(len(data)), // TCP length (32 bits), w/0 pseudoheader
-			0, 0, 0,
-			6, // protocol number for TCP
-		}...)
-	}
-
-	body := make([]byte, 0, len(pseudoHeader)+len(data))
-	body = append(body, pseudoHeader...)
-	body = append(body, data...)
-
-	bodyLen := len(body)
-
-	var word uint16
-	var csum uint32
-
-	for i := 0; i+1 < bodyLen; i += 2 {
-		word = uint16(body[i])<<8 | uint16(body[i+1])
-		csum += uint32(word)
-	}
-
-	if bodyLen%2 != 0 {
-		csum += uint32(body[len(body)-1])
-	}
-
-	csum = (csum >> 16) + (csum & 0xffff)
-	csum = csum + (csum >> 16)
-
-	return uint16(^csum)
+	return pseudoHeaderChecksum(af, syscall.IPPROTO_TCP, data, srcip, dstip)
 }
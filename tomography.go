@@ -0,0 +1,281 @@
+/**
+ * Copyright (c) 2016-present, Facebook, Inc.
+ * All rights reserved.
+ *
+ * This source code is licensed under the BSD-style license found in the
+ * LICENSE file in the root directory of this source tree. An additional grant
+ * of patent rights can be found in the PATENTS file in the same directory.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// the name of the near end of the first link on every path
+const tomographySource = "source"
+
+// LinkLoss is the loss rate of a link estimated from the loss of all the paths crossing it
+type LinkLoss struct {
+	// the link goes from the hop at the given ttl to the hop at FarTTL, ttl 0 being us; that is the next ttl,
+	// unless the hops in between did not respond and the link stands for the whole segment
+	TTL    int
+	FarTTL int
+	From   string
+	To     string
+	Loss   float64
+	// the standard error of the estimate and the confidence interval
+	StdErr float64
+	Lower  float64
+	Upper  float64
+	// number of measurements, source port and ttl pairs, involving the link
+	Measurements int
+}
+
+//
+// Solve the per-path loss for per-link loss. The probes to a given ttl on a given path make it back if they
+// survive every link up to that ttl, so in the log space the hit rate of the path at the ttl is the sum of
+// the log transmission rates of those links. With many source ports sharing the links this gives an over
+// determined linear system, solved with weighted least squares: every measurement is weighted by the inverse
+// of the (binomial, delta method) variance of its log hit rate. The covariance of the estimates is the inverse
+// of the normal matrix, which gives the standard errors. Hops in the exclude vectors do not give measurements.
+// The hops without a responder give no measurements either and may be any router, so the links around them
+// make a single link between the responders on either side, and the ttls past the last responder are left out.
+// The links never measured together make independent systems, each solved on its own
+//
+func estimateLinkLoss(sent, rcvd map[int] /* src port */ []int, hops map[int] /* src port */ []string, exclude map[int] /* src port */ []bool, alpha float64) []LinkLoss {
+	type linkKey struct {
+		ttl, farTTL int
+		from, to    string
+	}
+	// the links crossed by the probes to some ttl of some path, and the log hit rate seen there with its weight
+	type measurement struct {
+		links []int
+		y, w  float64
+	}
+
+	var ports []int
+	for srcPort := range hops {
+		ports = append(ports, srcPort)
+	}
+	sort.Ints(ports)
+
+	// number the links as the measurements cross them
+	index := make(map[linkKey]int)
+	var links []linkKey
+	var measurements []measurement
+	for _, srcPort := range ports {
+		var path []linkKey
+		from, fromTTL := tomographySource, 0
+		for ttl, name := range hops[srcPort] {
+			if unresolvedHop(name) {
+				continue
+			}
+			path = append(path, linkKey{ttl: fromTTL, farTTL: ttl + 1, from: from, to: name})
+			from, fromTTL = name, ttl+1
+
+			if ttl >= len(sent[srcPort]) || sent[srcPort][ttl] == 0 {
+				continue
+			}
+			if ttl < len(exclude[srcPort]) && exclude[srcPort][ttl] {
+				continue
+			}
+			// keep the hit rate away from 0 and 1 for the variance, and away from 0 for the log
+			s := float64(sent[srcPort][ttl])
+			r := float64(rcvd[srcPort][ttl])
+			smoothed := (r + 0.5) / (s + 1)
+			m := measurement{y: -math.Log(math.Max(r, 0.5) / s), w: (s + 1) * smoothed / (1 - smoothed)}
+			for _, key := range path {
+				i, ok := index[key]
+				if !ok {
+					i = len(links)
+					index[key] = i
+					links = append(links, key)
+				}
+				m.links = append(m.links, i)
+			}
+			measurements = append(measurements, m)
+		}
+	}
+
+	n := len(links)
+	if n == 0 {
+		return nil
+	}
+
+	// the links measured together end up in the same component
+	parent := make([]int, n)
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for _, m := range measurements {
+		for _, i := range m.links[1:] {
+			parent[find(i)] = find(m.links[0])
+		}
+	}
+	components := make(map[int][]int)
+	position := make([]int, n)
+	for i := range links {
+		root := find(i)
+		position[i] = len(components[root])
+		components[root] = append(components[root], i)
+	}
+
+	// the normal equations of every component: (A'WA) x = A'Wy
+	normals := make(map[int][][]float64)
+	rhs := make([]float64, n)
+	counts := make([]int, n)
+	for root, members := range components {
+		normals[root] = make([][]float64, len(members))
+		for i := range members {
+			normals[root][i] = make([]float64, len(members))
+		}
+	}
+	for _, m := range measurements {
+		normal := normals[find(m.links[0])]
+		for _, i := range m.links {
+			counts[i]++
+			rhs[i] += m.w * m.y
+			for _, j := range m.links {
+				normal[position[i]][position[j]] += m.w
+			}
+		}
+	}
+
+	z := normalQuantile(1 - alpha/2)
+	// back to loss rates, links cannot create packets
+	loss := func(x float64) float64 {
+		return math.Max(0, 1-math.Exp(-x))
+	}
+
+	var result []LinkLoss
+	for root, members := range components {
+		covariance := invertMatrix(normals[root])
+		for p, i := range members {
+			var x float64
+			for q, j := range members {
+				x += covariance[p][q] * rhs[j]
+			}
+			stdErr := math.Sqrt(math.Max(covariance[p][p], 0))
+
+			key := links[i]
+			result = append(result, LinkLoss{
+				TTL:          key.ttl,
+				FarTTL:       key.farTTL,
+				From:         key.from,
+				To:           key.to,
+				Loss:         loss(x),
+				StdErr:       math.Exp(-x) * stdErr,
+				Lower:        loss(x - z*stdErr),
+				Upper:        loss(x + z*stdErr),
+				Measurements: counts[i],
+			})
+		}
+	}
+	sort.Sort(linksByLoss(result))
+
+	return result
+}
+
+//
+// Invert the symmetric positive semi-definite matrix with Gauss-Jordan elimination. Links that always show up
+// together on the paths cannot be told apart, so a tiny ridge keeps the matrix invertible; their estimates
+// then share the loss and come with huge standard errors
+//
+func invertMatrix(m [][]float64) [][]float64 {
+	n := len(m)
+
+	var scale float64
+	for i := range m {
+		scale = math.Max(scale, m[i][i])
+	}
+	ridge := 1e-9 * math.Max(scale, 1)
+
+	a := make([][]float64, n)
+	for i := range a {
+		a[i] = make([]float64, 2*n)
+		copy(a[i], m[i])
+		a[i][i] += ridge
+		a[i][n+i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(a[row][col]) > math.Abs(a[pivot][col]) {
+				pivot = row
+			}
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+
+		p := a[col][col]
+		for k := range a[col] {
+			a[col][k] /= p
+		}
+		for row := 0; row < n; row++ {
+			if row == col || a[row][col] == 0 {
+				continue
+			}
+			f := a[row][col]
+			for k := range a[row] {
+				a[row][k] -= f * a[col][k]
+			}
+		}
+	}
+
+	inverse := make([][]float64, n)
+	for i := range inverse {
+		inverse[i] = a[i][n:]
+	}
+	return inverse
+}
+
+type linksByLoss []LinkLoss
+
+func (l linksByLoss) Len() int      { return len(l) }
+func (l linksByLoss) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l linksByLoss) Less(i, j int) bool {
+	if l[i].Loss != l[j].Loss {
+		return l[i].Loss > l[j].Loss
+	}
+	if l[i].TTL != l[j].TTL {
+		return l[i].TTL < l[j].TTL
+	}
+	if l[i].From != l[j].From {
+		return l[i].From < l[j].From
+	}
+	return l[i].To < l[j].To
+}
+
+//
+// print the estimated link loss rates, the worst links first
+//
+func printLinkLoss(links []LinkLoss) {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"TTL", "link", "loss %", "std err %", "measurements"})
+	for _, l := range links {
+		ttl := fmt.Sprintf("%d", l.TTL)
+		if l.FarTTL > l.TTL+1 {
+			ttl = fmt.Sprintf("%d-%d", l.TTL, l.FarTTL)
+		}
+		table.Append([]string{ttl, fmt.Sprintf("%s -> %s", l.From, l.To),
+			fmt.Sprintf("%.1f [%.1f-%.1f]", 100*l.Loss, 100*l.Lower, 100*l.Upper), fmt.Sprintf("%.1f", 100*l.StdErr), fmt.Sprintf("%d", l.Measurements)})
+	}
+
+	fmt.Fprintf(os.Stdout, "Link loss tomography:\n")
+	table.Render()
+	fmt.Fprintf(os.Stdout, "\n")
+}
@@ -0,0 +1,139 @@
+/**
+ * Copyright (c) 2016-present, Facebook, Inc.
+ * All rights reserved.
+ *
+ * This source code is licensed under the BSD-style license found in the
+ * LICENSE file in the root directory of this source tree. An additional grant
+ * of patent rights can be found in the PATENTS file in the same directory.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"syscall"
+)
+
+const (
+	udpHdrSize int = 8
+	// the payload always carries the 2-byte checksum fixup word
+	udpFixupSize int = 2
+	// the unprivileged probe payload: the ttl, the tag and the check byte
+	udpPayloadSize int = 4
+)
+
+// UDPHeader defines the UDP header struct
+type UDPHeader struct {
+	Source      uint16
+	Destination uint16
+	Length      uint16
+	Checksum    uint16
+}
+
+//
+// create & serialize a UDP probe (header + payload). Just like Paris traceroute, we keep
+// the flow identifier (ports) intact and hide the probe data in the fields that routers
+// quote back in their ICMP messages: the ttl goes into the length and the given checksum,
+// the probe tag hidden with udpProbeChecksum, becomes the checksum. The first two bytes
+// of payload are adjusted so that the checksum comes out to be the value we want.
+//
+func makeUDPPacket(af string, srcAddr, dstAddr *net.IP, srcPort, dstPort, ttl int, checksum uint16) []byte {
+	// zero checksum means "no checksum" in UDP, avoid it
+	if checksum == 0 {
+		checksum = 0xffff
+	}
+
+	payload := make([]byte, udpFixupSize+ttl)
+	UDPHeader := UDPHeader{
+		Source:      uint16(srcPort),
+		Destination: uint16(dstPort),
+		Length:      uint16(udpHdrSize + len(payload)),
+		Checksum:    0,
+	}
+
+	// checksum of the packet with zero fixup word
+	packet := append(UDPHeader.Serialize(), payload...)
+	csum := udpChecksum(af, packet, srcAddr, dstAddr)
+
+	binary.BigEndian.PutUint16(payload, checksumFixup(csum, checksum))
+	UDPHeader.Checksum = checksum
+
+	return append(UDPHeader.Serialize(), payload...)
+}
+
+//
+// The checksum has no room for a check byte next to the tag, so the tag goes out
+// XORed with a key only this run knows, derived from the flow and the ttl
+//
+func udpProbeChecksum(probe Probe) uint16 {
+	return uint16(probe.tag) ^ probeTagKey(probe.srcPort, probe.ttl)
+}
+
+// Recover the tag of a UDP probe from its checksum
+func udpProbeTag(srcPort, ttl int, checksum uint16) uint32 {
+	key := probeTagKey(srcPort, ttl)
+	// a zero checksum went out as all ones
+	if checksum == 0xffff && !ownTag(uint32(checksum^key)) {
+		checksum = 0
+	}
+	return uint32(checksum ^ key)
+}
+
+// Parse packet into UDPHeader structure
+func parseUDPHeader(data []byte) *UDPHeader {
+	var udp UDPHeader
+
+	r := bytes.NewReader(data)
+
+	binary.Read(r, binary.BigEndian, &udp.Source)
+	binary.Read(r, binary.BigEndian, &udp.Destination)
+	binary.Read(r, binary.BigEndian, &udp.Length)
+	binary.Read(r, binary.BigEndian, &udp.Checksum)
+
+	return &udp
+}
+
+// Serialize emits raw bytes for the header
+func (udp *UDPHeader) Serialize() []byte {
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, udp.Source)
+	binary.Write(buf, binary.BigEndian, udp.Destination)
+	binary.Write(buf, binary.BigEndian, udp.Length)
+	binary.Write(buf, binary.BigEndian, udp.Checksum)
+
+	return buf.Bytes()
+}
+
+// Recover the ttl that was encoded into the length of a UDP probe
+func (udp *UDPHeader) probeTTL() int {
+	return int(udp.Length) - udpHdrSize - udpFixupSize
+}
+
+//
+// UDP Checksum, works for both v4 and v6 IP addresses
+//
+func udpChecksum(af string, data []byte, srcip, dstip *net.IP) uint16 {
+	return pseudoHeaderChecksum(af, syscall.IPPROTO_UDP, data, srcip, dstip)
+}
+
+//
+// create the payload of an unprivileged UDP probe: the kernel builds the headers for us,
+// but hands the payload back with every error it queues, so the ttl, the tag and
+// the check byte of the probe travel in the payload itself
+//
+func makeUDPPayload(probe Probe) []byte {
+	payload := make([]byte, udpPayloadSize)
+	payload[0] = byte(probe.ttl)
+	binary.BigEndian.PutUint16(payload[1:], uint16(probe.tag))
+	payload[3] = byte(probeCheck(probe))
+	return payload
+}
+
+// Recover the probe of the given source port from an unprivileged UDP probe payload, and tell if this run has sent it
+func parseUDPPayload(srcPort int, payload []byte) (Probe, bool) {
+	probe := Probe{srcPort: srcPort, ttl: int(payload[0]), tag: uint32(binary.BigEndian.Uint16(payload[1:]))}
+	return probe, ownTag(probe.tag) && uint32(payload[3]) == probeCheck(probe)
+}
@@ -10,6 +10,7 @@
 package main
 
 import (
+	"net"
 	"sync"
 )
 
@@ -72,3 +73,72 @@ func merge(cs ...chan interface{}) chan interface{} {
 
 	return out
 }
+
+//
+// Internet checksum over the transport pseudo header and data, works for both v4 and v6 IP addresses
+//
+func pseudoHeaderChecksum(af string, proto int, data []byte, srcip, dstip *net.IP) uint16 {
+
+	// the pseudo header used for transport c-sum computation
+	var pseudoHeader []byte
+
+	switch {
+	case af == "ip4":
+		pseudoHeader = append(pseudoHeader, srcip.To4()...)
+		pseudoHeader = append(pseudoHeader, dstip.To4()...)
+		pseudoHeader = append(pseudoHeader, []byte{
+			0,
+			byte(proto),                           // protocol number
+			byte(len(data) >> 8), byte(len(data)), // transport length (16 bits), w/o pseudoheader
+		}...)
+	case af == "ip6":
+		pseudoHeader = append(pseudoHeader, srcip.To16()...)
+		pseudoHeader = append(pseudoHeader, dstip.To16()...)
+		pseudoHeader = append(pseudoHeader, []byte{
+			0, 0, byte(len(data) >> 8), byte(len(data)), // transport length (32 bits), w/o pseudoheader
+			0, 0, 0,
+			byte(proto), // protocol number
+		}...)
+	}
+
+	body := make([]byte, 0, len(pseudoHeader)+len(data))
+	body = append(body, pseudoHeader...)
+	body = append(body, data...)
+
+	return internetChecksum(body)
+}
+
+//
+// RFC 1071 ones' complement checksum of the given bytes
+//
+func internetChecksum(body []byte) uint16 {
+	bodyLen := len(body)
+
+	var word uint16
+	var csum uint32
+
+	for i := 0; i+1 < bodyLen; i += 2 {
+		word = uint16(body[i])<<8 | uint16(body[i+1])
+		csum += uint32(word)
+	}
+
+	if bodyLen%2 != 0 {
+		csum += uint32(body[len(body)-1]) << 8
+	}
+
+	csum = (csum >> 16) + (csum & 0xffff)
+	csum = csum + (csum >> 16)
+
+	return uint16(^csum)
+}
+
+//
+// Find the 16-bit word that, appended to a packet whose checksum is currently
+// csum, makes the checksum equal to target (the Paris traceroute trick)
+//
+func checksumFixup(csum, target uint16) uint16 {
+	// ones' complement addition of ~target and csum
+	sum := uint32(^target) + uint32(csum)
+	sum = (sum >> 16) + (sum & 0xffff)
+	return uint16(sum)
+}